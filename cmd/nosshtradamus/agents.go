@@ -0,0 +1,80 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"nosshtradamus/internal/identity"
+	"nosshtradamus/internal/sshproxy"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"log"
+	"net"
+)
+
+// agentKeys are the keys held by the proxy's SSH agents. The agents are connected to afresh for each authentication
+// with the target, so that keys added to an agent after the proxy started are offered, and a restarted agent is found
+// again.
+type agentKeys struct {
+	sockets        []string // tried in order
+	identitiesOnly bool     // only offer the keys of these identities
+	identities     []*identity.Identity
+	certs          []*ssh.Certificate // from certificate files whose private keys no identity holds
+	logger         *log.Logger
+}
+
+// signers lists the keys of every agent that can be reached, followed by the certificates for them. The connections to
+// the agents stay open (for signing) until the session's authentication in progress is over.
+func (ak *agentKeys) signers(session *sshproxy.Session) []ssh.Signer {
+	var signers []ssh.Signer
+	byKey := map[string]ssh.Signer{}
+	for _, socket := range ak.sockets {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			ak.logger.Printf("%v: agent %s: %v", session.RemoteAddr(), socket, err)
+			continue
+		}
+		session.CloseAfterAuth(conn)
+		agentSigners, err := agent.NewClient(conn).Signers()
+		if err != nil {
+			ak.logger.Printf("%v: agent %s: listing keys: %v", session.RemoteAddr(), socket, err)
+			continue
+		}
+		if ak.identitiesOnly {
+			agentSigners = identity.Only(agentSigners, ak.identities)
+		}
+		for _, signer := range agentSigners {
+			if keyID := identity.KeyID(signer.PublicKey()); byKey[keyID] == nil {
+				signers = append(signers, signer)
+				byKey[keyID] = signer
+			}
+		}
+	}
+	for _, cert := range ak.certs {
+		signer, found := byKey[identity.KeyID(cert.Key)]
+		if !found || byKey[identity.KeyID(cert)] != nil {
+			continue // not an agent key, or the agent also holds the certificate
+		}
+		if certSigner, err := ssh.NewCertSigner(cert, signer); err == nil {
+			signers = append(signers, certSigner)
+		}
+	}
+	return signers
+}
@@ -0,0 +1,329 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"nosshtradamus/internal/identity"
+	"nosshtradamus/internal/sshproxy"
+
+	"golang.org/x/crypto/ssh"
+
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unlockPolicy governs who may sign with an encrypted identity once its passphrase has been entered, and for how long.
+type unlockPolicy struct {
+	perUser     bool          // each downstream user unlocks the key for themselves, rather than for everyone
+	idleTimeout time.Duration // forget a decrypted key not used for this long (0: never)
+	lifetime    time.Duration // forget a decrypted key this long after it was unlocked (0: never)
+	confirm     bool          // ask the downstream user to confirm each use of an unlocked key
+}
+
+// passphraseAttempts is how many times a user may enter a wrong passphrase, as for OpenSSH's NumberOfPasswordPrompts.
+const passphraseAttempts = 3
+
+var errKeyUseDenied = errors.New("use of key declined")
+
+// askingSession is what a deferredSigner needs of a *sshproxy.Session: who it is for, and a way to ask its user.
+type askingSession interface {
+	ClientKey() ssh.PublicKey
+	Target() *sshproxy.Target
+	Ask(question *sshproxy.ProxiedAuthQuestion) error
+	CloseAfterAuth(resource io.Closer)
+}
+
+// unlockedKey is the decrypted private key of a deferredSigner, for one unlock scope.
+type unlockedKey struct {
+	signer     ssh.Signer
+	key        interface{} // the decrypted key itself, erased when forgotten
+	unlockedAt time.Time
+	lastUsed   time.Time
+	expiry     *time.Timer
+}
+
+// deferredSigner is an identity whose private key is decrypted only once it is needed to sign, by asking a downstream
+// user for its passphrase. It is shared among all sessions, and must be bound to a session before it can sign. The
+// decrypted key is kept (and shared) according to the unlock policy.
+type deferredSigner struct {
+	identity *identity.Identity
+	policy   *unlockPolicy
+	now      func() time.Time // the clock, replaceable in tests
+
+	mutex    sync.Mutex
+	unlocked map[string]*unlockedKey // by unlock scope
+}
+
+func newDeferredSigner(id *identity.Identity, policy *unlockPolicy) *deferredSigner {
+	return &deferredSigner{identity: id, policy: policy, now: time.Now, unlocked: map[string]*unlockedKey{}}
+}
+
+func (ds *deferredSigner) PublicKey() ssh.PublicKey {
+	return ds.identity.PublicKey
+}
+
+// scope identifies who a key unlocked by the session's user is unlocked for, and whether that is the session alone.
+// Verified clients are told apart by the key they authenticated to the proxy with. Anyone can claim the username and
+// address of an unverified client (e.g. every client of a loopback listener), so a key one unlocks is kept only for
+// its own session, until the authentication in progress is over.
+func (ds *deferredSigner) scope(session askingSession) (string, bool) {
+	if !ds.policy.perUser {
+		return "", false
+	}
+	if clientKey := session.ClientKey(); clientKey != nil {
+		return "key " + ssh.FingerprintSHA256(identity.CertifiedKey(clientKey)), false
+	}
+	return fmt.Sprintf("session %p", session), true
+}
+
+// Algorithms are the signature algorithms the key supports (e.g. the SHA-2 variants of RSA), which are known before
+// the key is decrypted.
+func (ds *deferredSigner) Algorithms() []string {
+	if keyType := ds.identity.PublicKey.Type(); keyType != ssh.KeyAlgoRSA {
+		return []string{keyType}
+	}
+	return []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA}
+}
+
+// sign signs the data on behalf of the session with the algorithm (or the key's default, if empty), asking its user for
+// the key's passphrase if it isn't unlocked for them (or has expired), and for confirmation if the policy requires it.
+func (ds *deferredSigner) sign(session askingSession, rand io.Reader, data []byte,
+	algorithm string) (*ssh.Signature, error) {
+	scope, sessionOnly := ds.scope(session)
+	ds.mutex.Lock()
+	if key := ds.unlocked[scope]; key != nil && ds.expired(key) {
+		ds.forget(scope)
+	}
+	unlocked := ds.unlocked[scope] != nil
+	ds.mutex.Unlock()
+
+	// not holding the lock while asking, so that one user's prompt does not stall other sessions
+	if !unlocked {
+		if err := ds.askPassphrase(session, scope); err != nil {
+			return nil, err
+		}
+		if sessionOnly {
+			session.CloseAfterAuth(&scopeForgetter{deferred: ds, scope: scope})
+		}
+	} else if ds.policy.confirm {
+		if err := ds.askConfirmation(session); err != nil {
+			return nil, err
+		}
+	}
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	key := ds.unlocked[scope]
+	if key == nil {
+		return nil, fmt.Errorf("key %s expired before use", ds.identity.Path)
+	}
+	key.lastUsed = ds.now()
+	if algorithm == "" {
+		return key.signer.Sign(rand, data)
+	}
+	algorithmSigner, ok := key.signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("key %s cannot sign with %s", ds.identity.Path, algorithm)
+	}
+	return algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// askPassphrase asks the session's user for the key's passphrase, unlocking the key for the scope. A wrong passphrase
+// is asked for again, up to passphraseAttempts times in all.
+func (ds *deferredSigner) askPassphrase(session askingSession, scope string) error {
+	message := fmt.Sprintf("Enter passphrase for key '%s'", ds.identity.Path)
+	for attempt := 1; ; attempt++ {
+		retry := attempt < passphraseAttempts
+		answer := make(chan error, 1)
+		err := session.Ask(&sshproxy.ProxiedAuthQuestion{
+			Message: message,
+			Prompt:  "Passphrase: ",
+			Echo:    false,
+			OnAnswer: func(passphrase string) bool {
+				err := ds.decrypt(scope, []byte(passphrase))
+				answer <- err
+				return err == nil || (retry && errors.Is(err, x509.IncorrectPasswordError))
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if err = <-answer; err == nil || !retry || !errors.Is(err, x509.IncorrectPasswordError) {
+			return err
+		}
+		message = fmt.Sprintf("Bad passphrase, try again for key '%s'", ds.identity.Path)
+	}
+}
+
+// decrypt unlocks the key for the scope with the passphrase, which is erased afterwards.
+func (ds *deferredSigner) decrypt(scope string, passphrase []byte) error {
+	defer func() {
+		for idx := range passphrase {
+			passphrase[idx] = 0
+		}
+	}()
+	key, err := ds.identity.DecryptKey(passphrase)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		identity.Zero(key)
+		return err
+	}
+	ds.unlock(scope, signer, key)
+	return nil
+}
+
+func (ds *deferredSigner) askConfirmation(session askingSession) error {
+	destination := "the target"
+	if target := session.Target(); target != nil {
+		destination = target.String()
+	}
+	answer := make(chan bool, 1)
+	err := session.Ask(&sshproxy.ProxiedAuthQuestion{
+		Message: fmt.Sprintf("Allow use of key '%s' (%s) to authenticate to %s?", ds.identity.Path,
+			ssh.FingerprintSHA256(ds.identity.PublicKey), destination),
+		Prompt: "Confirm (yes/no): ",
+		Echo:   true,
+		OnAnswer: func(response string) bool {
+			answer <- strings.EqualFold(strings.TrimSpace(response), "yes")
+			return true
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if !<-answer {
+		return errKeyUseDenied
+	}
+	return nil
+}
+
+// unlock keeps the decrypted key for the scope, until the policy's idle timeout or lifetime expires.
+func (ds *deferredSigner) unlock(scope string, signer ssh.Signer, key interface{}) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.forget(scope)
+	now := ds.now()
+	unlocked := &unlockedKey{signer: signer, key: key, unlockedAt: now, lastUsed: now}
+	ds.unlocked[scope] = unlocked
+	ds.scheduleExpiry(scope, unlocked)
+}
+
+// scheduleExpiry arranges for the key to be forgotten once it expires, rechecking when it was last used.
+func (ds *deferredSigner) scheduleExpiry(scope string, unlocked *unlockedKey) {
+	var expires time.Time
+	if ds.policy.idleTimeout > 0 {
+		expires = unlocked.lastUsed.Add(ds.policy.idleTimeout)
+	}
+	if ds.policy.lifetime > 0 {
+		if end := unlocked.unlockedAt.Add(ds.policy.lifetime); expires.IsZero() || end.Before(expires) {
+			expires = end
+		}
+	}
+	if expires.IsZero() {
+		return
+	}
+	unlocked.expiry = time.AfterFunc(expires.Sub(ds.now()), func() {
+		ds.mutex.Lock()
+		defer ds.mutex.Unlock()
+		if ds.unlocked[scope] != unlocked {
+			return // already forgotten
+		}
+		if !ds.expired(unlocked) {
+			ds.scheduleExpiry(scope, unlocked) // used since
+			return
+		}
+		ds.forget(scope)
+	})
+}
+
+// expired reports whether the key has gone unused for too long, or was unlocked too long ago.
+func (ds *deferredSigner) expired(unlocked *unlockedKey) bool {
+	now := ds.now()
+	return (ds.policy.idleTimeout > 0 && !now.Before(unlocked.lastUsed.Add(ds.policy.idleTimeout))) ||
+		(ds.policy.lifetime > 0 && !now.Before(unlocked.unlockedAt.Add(ds.policy.lifetime)))
+}
+
+// forget erases the decrypted key of the scope, if any; the mutex must be held.
+func (ds *deferredSigner) forget(scope string) {
+	unlocked := ds.unlocked[scope]
+	if unlocked == nil {
+		return
+	}
+	if unlocked.expiry != nil {
+		unlocked.expiry.Stop()
+	}
+	identity.Zero(unlocked.key)
+	delete(ds.unlocked, scope)
+}
+
+// scopeForgetter forgets a key unlocked for a single session once it is closed, at the end of the session's
+// authentication (see CloseAfterAuth).
+type scopeForgetter struct {
+	deferred *deferredSigner
+	scope    string
+}
+
+func (sf *scopeForgetter) Close() error {
+	sf.deferred.mutex.Lock()
+	defer sf.deferred.mutex.Unlock()
+	sf.deferred.forget(sf.scope)
+	return nil
+}
+
+// boundSigner is a deferredSigner bound to the session that will be asked for its passphrase, optionally presenting a
+// certificate for its key. It is a MultiAlgorithmSigner, so that RSA keys sign with SHA-2 where the target supports it.
+type boundSigner struct {
+	deferred *deferredSigner
+	session  askingSession
+	cert     *ssh.Certificate
+}
+
+func (bs *boundSigner) bind(session askingSession) *boundSigner {
+	return &boundSigner{deferred: bs.deferred, session: session, cert: bs.cert}
+}
+
+func (bs *boundSigner) PublicKey() ssh.PublicKey {
+	if bs.cert != nil {
+		return bs.cert
+	}
+	return bs.deferred.PublicKey()
+}
+
+func (bs *boundSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return bs.SignWithAlgorithm(rand, data, "")
+}
+
+func (bs *boundSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if bs.session == nil {
+		return nil, fmt.Errorf("no session to unlock deferred key")
+	}
+	return bs.deferred.sign(bs.session, rand, data, algorithm)
+}
+
+func (bs *boundSigner) Algorithms() []string {
+	return bs.deferred.Algorithms()
+}
@@ -0,0 +1,364 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"nosshtradamus/internal/identity"
+	"nosshtradamus/internal/sshproxy"
+
+	"golang.org/x/crypto/ssh"
+
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authenticate runs a server accepting only the signature algorithm, trusting the key or certificate authority, and
+// reports whether the signer authenticates to it.
+func authenticate(t *testing.T, signer ssh.Signer, algorithm string, trusted ssh.PublicKey) error {
+	hostKey, err := sshproxy.GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool { return string(auth.Marshal()) == string(trusted.Marshal()) },
+		UserKeyFallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(trusted.Marshal()) {
+				return nil, errKeyUseDenied
+			}
+			return nil, nil
+		},
+	}
+	config := &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate, PublicKeyAuthAlgorithms: []string{algorithm}}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if serverConn, _, _, err := ssh.NewServerConn(conn, config); err == nil {
+			_ = serverConn.Close()
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "tester",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		_ = client.Close()
+	}
+	return err
+}
+
+func TestDeferredRSASignatureAlgorithms(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySigner, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deferred := newDeferredSigner(&identity.Identity{Path: "id_rsa", PublicKey: keySigner.PublicKey()},
+		&unlockPolicy{})
+	deferred.unlock("", keySigner, key)
+	signer := (&boundSigner{deferred: deferred}).bind(&sshproxy.Session{})
+
+	caSigner, err := sshproxy.GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             keySigner.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"tester"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	certSigner := (&boundSigner{deferred: deferred, cert: cert}).bind(&sshproxy.Session{})
+
+	for _, algorithm := range []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512} {
+		if err := authenticate(t, signer, algorithm, keySigner.PublicKey()); err != nil {
+			t.Errorf("expected the deferred key to authenticate with %s: %v", algorithm, err)
+		}
+		if err := authenticate(t, certSigner, algorithm, caSigner.PublicKey()); err != nil {
+			t.Errorf("expected the deferred key's certificate to authenticate with %s: %v", algorithm, err)
+		}
+	}
+}
+
+// scriptedSession is a session whose user answers the deferredSigner's questions from a script.
+type scriptedSession struct {
+	clientKey ssh.PublicKey
+	answers   []string    // given to the questions asked, in turn
+	asked     []string    // the questions asked
+	closers   []io.Closer // registered with CloseAfterAuth
+}
+
+func (ss *scriptedSession) ClientKey() ssh.PublicKey {
+	return ss.clientKey
+}
+
+func (ss *scriptedSession) Target() *sshproxy.Target {
+	return nil
+}
+
+func (ss *scriptedSession) Ask(question *sshproxy.ProxiedAuthQuestion) error {
+	ss.asked = append(ss.asked, question.Message)
+	if len(ss.answers) == 0 {
+		return sshproxy.ErrNotAuthenticating
+	}
+	answer := ss.answers[0]
+	ss.answers = ss.answers[1:]
+	question.OnAnswer(answer)
+	return nil
+}
+
+func (ss *scriptedSession) CloseAfterAuth(resource io.Closer) {
+	ss.closers = append(ss.closers, resource)
+}
+
+// endAuth ends the session's authentication, closing what was registered with CloseAfterAuth.
+func (ss *scriptedSession) endAuth() {
+	for _, closer := range ss.closers {
+		_ = closer.Close()
+	}
+	ss.closers = nil
+}
+
+// testClock is a clock for a deferredSigner, advanced by the test.
+type testClock struct {
+	time time.Time
+}
+
+func (tc *testClock) now() time.Time {
+	return tc.time
+}
+
+const testPassphrase = "correct horse"
+
+// newTestDeferredSigner makes a deferredSigner for a new ed25519 key encrypted with testPassphrase, on a test clock.
+func newTestDeferredSigner(t *testing.T, policy *unlockPolicy) (*deferredSigner, *testClock) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(testPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	id, err := identity.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id.Encrypted() {
+		t.Fatal("expected the identity to be encrypted")
+	}
+	deferred := newDeferredSigner(id, policy)
+	clock := &testClock{time: time.Unix(1700000000, 0)}
+	deferred.now = clock.now
+	return deferred, clock
+}
+
+// unlockStep is a signature made with a deferredSigner by one of a test's sessions.
+type unlockStep struct {
+	advance time.Duration // how far the clock is moved on first
+	session int           // which session signs
+	answers []string      // its user's answers
+	asked   int           // how many questions the user is expected to be asked
+	fails   bool          // whether signing is expected to fail
+	endAuth bool          // whether the session's authentication ends after signing
+}
+
+func TestDeferredUnlockPolicy(t *testing.T) {
+	clientKey, err := sshproxy.GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unverified := func() *scriptedSession { return &scriptedSession{} }
+	verified := func() *scriptedSession { return &scriptedSession{clientKey: clientKey.PublicKey()} }
+	for _, test := range []struct {
+		name     string
+		policy   unlockPolicy
+		sessions []*scriptedSession
+		steps    []unlockStep
+	}{
+		{"shared", unlockPolicy{}, []*scriptedSession{unverified(), unverified()}, []unlockStep{
+			{session: 0, answers: []string{testPassphrase}, asked: 1},
+			{session: 1, asked: 0},
+		}},
+		{"idle expiry", unlockPolicy{idleTimeout: 10 * time.Minute}, []*scriptedSession{unverified()}, []unlockStep{
+			{answers: []string{testPassphrase}, asked: 1},
+			{advance: 9 * time.Minute, asked: 0},
+			{advance: 9 * time.Minute, asked: 0}, // each use restarts the idle timeout
+			{advance: 10 * time.Minute, answers: []string{testPassphrase}, asked: 1},
+		}},
+		{"lifetime expiry", unlockPolicy{lifetime: 10 * time.Minute}, []*scriptedSession{unverified()}, []unlockStep{
+			{answers: []string{testPassphrase}, asked: 1},
+			{advance: 9 * time.Minute, asked: 0},
+			{advance: time.Minute, answers: []string{testPassphrase}, asked: 1},
+			{advance: 9 * time.Minute, asked: 0},
+		}},
+		{"expired unanswered", unlockPolicy{lifetime: time.Minute}, []*scriptedSession{unverified()}, []unlockStep{
+			{answers: []string{testPassphrase}, asked: 1},
+			{advance: time.Minute, asked: 1, fails: true},
+		}},
+		{"wrong passphrase retried", unlockPolicy{}, []*scriptedSession{unverified()}, []unlockStep{
+			{answers: []string{"wrong", "wronger", testPassphrase}, asked: 3},
+			{asked: 0},
+		}},
+		{"wrong passphrase limit", unlockPolicy{}, []*scriptedSession{unverified()}, []unlockStep{
+			{answers: []string{"wrong", "wronger", "wrongest", testPassphrase}, asked: 3, fails: true},
+			{answers: []string{testPassphrase}, asked: 1},
+		}},
+		{"confirm each use", unlockPolicy{confirm: true}, []*scriptedSession{unverified()}, []unlockStep{
+			{answers: []string{testPassphrase}, asked: 1},
+			{answers: []string{"yes"}, asked: 1},
+			{answers: []string{"no"}, asked: 1, fails: true},
+			{answers: []string{"YES "}, asked: 1},
+		}},
+		{"per user verified", unlockPolicy{perUser: true}, []*scriptedSession{verified(), verified(), unverified()},
+			[]unlockStep{
+				{session: 0, answers: []string{testPassphrase}, asked: 1, endAuth: true},
+				{session: 1, asked: 0},
+				{session: 2, answers: []string{testPassphrase}, asked: 1},
+			}},
+		{"per user unverified", unlockPolicy{perUser: true}, []*scriptedSession{unverified(), unverified()},
+			[]unlockStep{
+				{session: 0, answers: []string{testPassphrase}, asked: 1},
+				{session: 0, asked: 0, endAuth: true},
+				{session: 1, answers: []string{testPassphrase}, asked: 1},
+				{session: 0, answers: []string{testPassphrase}, asked: 1},
+			}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			policy := test.policy
+			deferred, clock := newTestDeferredSigner(t, &policy)
+			for idx, step := range test.steps {
+				clock.time = clock.time.Add(step.advance)
+				session := test.sessions[step.session]
+				session.answers, session.asked = step.answers, nil
+				signature, err := (&boundSigner{deferred: deferred}).bind(session).Sign(rand.Reader, []byte("data"))
+				if step.fails != (err != nil) {
+					t.Fatalf("step %d: expected failure %v, got %v", idx, step.fails, err)
+				}
+				if err == nil {
+					if err := deferred.PublicKey().Verify([]byte("data"), signature); err != nil {
+						t.Fatalf("step %d: %v", idx, err)
+					}
+				}
+				if len(session.asked) != step.asked {
+					t.Fatalf("step %d: expected %d questions, got %q", idx, step.asked, session.asked)
+				}
+				if step.endAuth {
+					session.endAuth()
+				}
+			}
+		})
+	}
+}
+
+func TestDeferredUnlockSameUserAndAddress(t *testing.T) {
+	// clients of a loopback listener all share an address, and unverified clients choose their own username: the key
+	// one unlocks must not be usable by another
+	deferred, _ := newTestDeferredSigner(t, &unlockPolicy{perUser: true})
+	first, second := &scriptedSession{answers: []string{testPassphrase}}, &scriptedSession{}
+	if _, err := (&boundSigner{deferred: deferred}).bind(first).Sign(rand.Reader, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&boundSigner{deferred: deferred}).bind(second).Sign(rand.Reader, []byte("data")); err == nil {
+		t.Fatal("expected a second session with the same username and address to need the passphrase")
+	}
+	if len(second.asked) != 1 || !strings.Contains(second.asked[0], "Enter passphrase") {
+		t.Fatalf("expected the second session to be asked for the passphrase, got %q", second.asked)
+	}
+
+	// and the key is forgotten once the first session's authentication is over
+	first.endAuth()
+	deferred.mutex.Lock()
+	defer deferred.mutex.Unlock()
+	if len(deferred.unlocked) != 0 {
+		t.Fatalf("expected the key to be forgotten, %d unlocked", len(deferred.unlocked))
+	}
+}
+
+func TestDeferredKeyErased(t *testing.T) {
+	deferred, _ := newTestDeferredSigner(t, &unlockPolicy{lifetime: 50 * time.Millisecond})
+	deferred.now = time.Now // expiring on a timer
+	session := &scriptedSession{answers: []string{testPassphrase}}
+	if _, err := (&boundSigner{deferred: deferred}).bind(session).Sign(rand.Reader, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	deferred.mutex.Lock()
+	key, ok := deferred.unlocked[""].key.(*ed25519.PrivateKey)
+	deferred.mutex.Unlock()
+	if !ok {
+		t.Fatalf("expected an ed25519 key, got %T", key)
+	}
+	if isErased(*key) {
+		t.Fatal("expected the unlocked key to be intact")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		deferred.mutex.Lock()
+		remaining := len(deferred.unlocked)
+		deferred.mutex.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the key to be forgotten once its lifetime expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !isErased(*key) {
+		t.Fatal("expected the forgotten key to be erased")
+	}
+}
+
+func isErased(key []byte) bool {
+	for _, b := range key {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
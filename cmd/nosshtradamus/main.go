@@ -19,19 +19,28 @@
 package main
 
 import (
+	"nosshtradamus/internal/hostcheck"
+	"nosshtradamus/internal/identity"
 	"nosshtradamus/internal/predictive"
+	"nosshtradamus/internal/sshconfig"
 	"nosshtradamus/internal/sshproxy"
 
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
 
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -55,212 +64,476 @@ func truthy(s string) bool {
 	}
 }
 
-type deferredSigner struct {
-	actual    ssh.Signer
-	force     func(*deferredSigner) error
-	internPub ssh.PublicKey
-}
-
-func (ds *deferredSigner) PublicKey() ssh.PublicKey {
-	if ds.internPub != nil {
-		return ds.internPub
+// listenRoute splits a -listen value into the address to listen on, and the target of its clients if one is given
+// ("address=host[:port]").
+func listenRoute(spec string) (string, string, error) {
+	address, target, routed := strings.Cut(spec, "=")
+	if !routed {
+		return spec, "", nil
 	}
-	if ds.actual == nil {
-		_ = ds.force(ds)
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		// no port specified (including bare IPv6 addresses)
+		host, port = strings.Trim(target, "[]"), "22"
 	}
-	return ds.actual.PublicKey()
-}
-func (ds *deferredSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
-	if ds.actual == nil {
-		if err := ds.force(ds); err != nil {
-			return nil, err
-		}
+	if host == "" {
+		return "", "", fmt.Errorf("-listen %s: no target host", spec)
+	}
+	if portNum, err := strconv.Atoi(port); err != nil || portNum < 1 || portNum > 65535 {
+		return "", "", fmt.Errorf("-listen %s: invalid target port %q", spec, port)
 	}
-	return ds.actual.Sign(rand, data)
+	return address, net.JoinHostPort(host, port), nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign-host-key" {
+		signHostKey(os.Args[2:])
+		return
+	}
+
 	port := 0
 	target := ""
 	printPredictiveVersion := false
 	noPrediction := false
 	var fakeDelay time.Duration
 	var optionArgs arrayFlags
+	configFile := ""
 	var identityArgs arrayFlags
+	jumpHosts := ""
+	targetFromUser := false
+	var allowTargets arrayFlags
 	agentForward := false
+	clientAgent := false
+	x11Forward := false
+	x11SpoofCookie := true
 	disableAgent := false
 	dumbAuth := false
 	authErrDetails := false
 	printTiming := false
 	noBanner := false
+	drainTimeout := 30 * time.Second
+	handshakeTimeout := 10 * time.Second
+	authTimeout := 2 * time.Minute
+	maxUnauthenticated := 10
+	authRate := 20.0
+	authBurst := 10
+	authorizedKeys := ""
+	var userCAs arrayFlags
+	requireClientKey := false
+	lendCredentials := ""
+	var listenAddrs arrayFlags
+	socketMode := "0600"
+	stdio := false
+	var hostKeyFiles arrayFlags
+	printHostKey := false
+	hostKeySecret := ""
+	listenCiphers := ""
+	listenKexAlgorithms := ""
+	listenMACs := ""
+	listenHostKeyAlgorithms := ""
+	logAlgorithms := false
+	var clientAliveInterval time.Duration
+	clientAliveCountMax := 3
+	keyUnlock := "shared"
+	var unlock unlockPolicy
 
-	flag.IntVar(&port, "port", 0, "Proxy listen port")
+	flag.IntVar(&port, "port", 0, "Proxy listen port (on the loopback interface)")
+	flag.Var(&listenAddrs, "listen",
+		"Proxy listen `address`es: host:port, [ipv6]:port, or unix:/path/to/socket, each optionally followed by "+
+			"=host[:port] to proxy its clients to a target of its own (repeatable)")
+	flag.StringVar(&socketMode, "socketMode", socketMode, "File `mode` (octal) of Unix domain sockets listened on")
+	flag.BoolVar(&stdio, "stdio", false, "Serve a single client over stdin/stdout (e.g. as an SSH ProxyCommand)")
+	flag.Var(&hostKeyFiles, "hostKey",
+		"Proxy host `key file`s, generated if missing (repeatable; default $HOME/.ssh/nosshtradamus_host_ed25519_key)")
+	flag.StringVar(&hostKeySecret, "hostKeySecret", "",
+		"Derive a distinct host key for the static -target, and each -listen target, from the master secret in this "+
+			"`file` (generated if missing)")
+	flag.BoolVar(&printHostKey, "printHostKey", false, "Print known_hosts lines for the proxy's host keys, and exit")
+	flag.StringVar(&listenCiphers, "listenCiphers", "",
+		"Cipher `algorithms` offered to clients, as for the Ciphers option (default OpenSSH's)")
+	flag.StringVar(&listenKexAlgorithms, "listenKexAlgorithms", "",
+		"Key exchange `algorithms` offered to clients, as for the KexAlgorithms option (default OpenSSH's)")
+	flag.StringVar(&listenMACs, "listenMACs", "",
+		"MAC `algorithms` offered to clients, as for the MACs option (default OpenSSH's)")
+	flag.StringVar(&listenHostKeyAlgorithms, "listenHostKeyAlgorithms", "",
+		"Host key `algorithms` offered to clients, as for the HostKeyAlgorithms option (default OpenSSH's)")
+	flag.BoolVar(&logAlgorithms, "logAlgorithms", false,
+		"Log the algorithms negotiated with each client and target")
 	flag.StringVar(&target, "target", "", "Target SSH host")
+	flag.BoolVar(&targetFromUser, "targetFromUser", false,
+		"Choose the target from the login username (user%host[:port] or user+host[:port])")
+	flag.Var(&allowTargets, "allowTarget", "Permitted `target pattern`s for -targetFromUser (repeatable)")
 	flag.BoolVar(&printPredictiveVersion, "version", false, "Display predictive backend version")
 	flag.BoolVar(&noPrediction, "nopredict", false, "Disable the mosh-based predictive backend")
 	flag.DurationVar(&fakeDelay, "fakeDelay", 0, "Artificial roundtrip latency added to sessions")
 	flag.BoolVar(&printTiming, "printTiming", false, "Print epoch synchronization timing messages")
 	flag.BoolVar(&noBanner, "noBanner", false, "Disable the Nosshtradamus proxy banner")
+	flag.DurationVar(&drainTimeout, "drainTimeout", drainTimeout, "Time open sessions are given to finish on shutdown")
+	flag.DurationVar(&handshakeTimeout, "handshakeTimeout", handshakeTimeout,
+		"Time clients are given for key exchange (0 for no limit)")
+	flag.DurationVar(&authTimeout, "authTimeout", authTimeout, "Time clients are given to authenticate (0 for no limit)")
+	flag.DurationVar(&clientAliveInterval, "clientAliveInterval", 0,
+		"Probe clients this often, closing sessions of clients that stop answering (0 to never probe)")
+	flag.IntVar(&clientAliveCountMax, "clientAliveCountMax", clientAliveCountMax,
+		"Unanswered client probes before a client is disconnected (0 to disconnect on the first)")
+	flag.IntVar(&maxUnauthenticated, "maxUnauthenticated", maxUnauthenticated,
+		"Maximum concurrent connections yet to authenticate (0 for no limit)")
+	flag.Float64Var(&authRate, "authRate", authRate,
+		"Authentication attempts allowed per minute from one source IP (0 for no limit)")
+	flag.IntVar(&authBurst, "authBurst", authBurst, "Authentication attempts allowed in a burst from one source IP")
+	flag.StringVar(&authorizedKeys, "authorizedKeys", "",
+		"`authorized_keys file` of client public keys accepted by the proxy itself")
+	flag.Var(&userCAs, "userCA", "`CA public key file`s trusted to sign client certificates (repeatable)")
+	flag.BoolVar(&requireClientKey, "requireClientKey", false,
+		"Reject clients that do not authenticate to the proxy with an authorized key")
+	flag.StringVar(&lendCredentials, "lendCredentials", "",
+		"Which clients may use the proxy's agent/identity keys with the target: `verified|anyone` "+
+			"(default verified when -authorizedKeys or -userCA is set, otherwise anyone)")
 
-	flag.Var(&optionArgs, "o", "Proxy `SSH client option`s (repeatable)")
+	flag.Var(&optionArgs, "o", "Proxy `SSH client option`s, as Keyword=value (repeatable)")
+	flag.StringVar(&configFile, "F", "",
+		"SSH client configuration `file` (default ~/.ssh/config and /etc/ssh/ssh_config; none to disable)")
 	flag.Var(&identityArgs, "i", "Proxy SSH client `identity file path`s (repeatable)")
+	flag.StringVar(&jumpHosts, "J", "", "Connect to the target via `[user@]host[:port]` jump hosts (comma separated)")
 	flag.BoolVar(&agentForward, "A", false, "Allow proxy SSH client to forward agent")
+	flag.BoolVar(&clientAgent, "clientAgent", false,
+		"Authenticate to the target with the client's forwarded agent (ssh -A), after the client authenticates to "+
+			"the proxy (no questions are relayed to the client)")
+	flag.BoolVar(&x11Forward, "X", false, "Allow X11 forwarding through the proxy")
+	flag.BoolVar(&x11SpoofCookie, "x11SpoofCookie", true,
+		"Send the target a fake X11 cookie, substituting the client's real cookie only within the proxy")
+	flag.StringVar(&keyUnlock, "keyUnlock", keyUnlock,
+		"Whom a passphrase protected identity is unlocked for once a client enters its passphrase: `shared|user` "+
+			"(everyone, or only the same client key, or only the same connection when unverified)")
+	flag.DurationVar(&unlock.idleTimeout, "keyIdleTimeout", 0,
+		"Forget unlocked identities unused for this long, asking for their passphrase again (0 for never)")
+	flag.DurationVar(&unlock.lifetime, "keyLifetime", 0,
+		"Forget unlocked identities this long after they were unlocked (0 for never)")
+	flag.BoolVar(&unlock.confirm, "keyConfirm", false,
+		"Ask clients to confirm each use of an already unlocked identity")
 	flag.BoolVar(&disableAgent, "a", false, "Disable use of SSH agent for key based authentication")
 	flag.BoolVar(&dumbAuth, "dumbauth", false, "Use 'dumb' authentication (send blank password)")
 	flag.BoolVar(&authErrDetails, "authErr", false, "Show details on authentication errors with target")
 	flag.Parse()
 
-	// create a map of SSH client options to their values
-	sshClientOptions := map[string]string{}
-	for _, option := range optionArgs {
-		kv := strings.SplitN(option, "=", 2)
-		if len(kv) == 2 {
-			sshClientOptions[kv[0]] = kv[1]
+	// a listener may proxy its clients to a target of its own; as with -targetFromUser, such targets are connected to
+	// with the configuration applying to all hosts, rather than that of a -target
+	listenTargets := map[string]string{} // by listen address
+	for idx, listenAddr := range listenAddrs {
+		address, listenTarget, err := listenRoute(listenAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		listenAddrs[idx] = address
+		if listenTarget == "" {
+			continue
 		}
+		if target != "" {
+			fmt.Fprintln(os.Stderr, "-listen addresses with targets of their own cannot be combined with -target")
+			os.Exit(2)
+		}
+		listenTargets[address] = listenTarget
 	}
 
-	// default to checking known hosts from $HOME/.ssh/known_hosts
-	userKnownHostsFile := ""
-	if home, ok := os.LookupEnv("HOME"); ok {
-		userKnownHostsFile = home + "/.ssh/known_hosts"
+	// the target may be a host alias, resolved with the SSH client configuration the same way the OpenSSH client
+	// would; with -targetFromUser, only configuration applying to all hosts is used
+	sshClientOptions, err := commandLineSettings(target, optionArgs, identityArgs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	// unless overridden by the client
-	if specifiedKnownHost, ok := sshClientOptions["UserKnownHostsFile"]; ok {
-		userKnownHostsFile = specifiedKnownHost
+	configFiles := []string{"~/.ssh/config", "/etc/ssh/ssh_config"}
+	if strings.EqualFold(configFile, "none") {
+		configFiles = nil
+	} else if configFile != "" {
+		if _, err := os.Stat(sshClientOptions.Expand(configFile)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		configFiles = []string{configFile}
 	}
-
-	// default to checking host keys
-	strictHostChecking := true
-	hostKeyChecker := ssh.InsecureIgnoreHostKey()
-	if specifiedStrictChecking, ok := sshClientOptions["StrictHostKeyChecking"]; ok {
-		strictHostChecking = truthy(specifiedStrictChecking)
+	for idx := range configFiles {
+		configFiles[idx] = sshClientOptions.Expand(configFiles[idx])
+	}
+	sshConfig, err := sshconfig.Load(configFiles...)
+	if err == nil {
+		err = sshConfig.Apply(sshClientOptions)
+		for _, warning := range sshClientOptions.Warnings() {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", warning)
+		}
+	}
+	if err == nil {
+		err = checkOptions(sshClientOptions)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if target != "" && !targetFromUser {
+		target = targetAddress(sshClientOptions)
 	}
-	if strictHostChecking && userKnownHostsFile == "" {
-		// asked for strict host key checking, but no known hosts file... die
-		panic("Strict host key checking enabled, but no known_hosts provided")
+	connectTimeout, _ := sshClientOptions.Duration("ConnectTimeout")
+	serverAliveInterval, _ := sshClientOptions.Duration("ServerAliveInterval")
+	serverAliveCountMax := 3 // OpenSSH's default; 0 is honored, giving up on the first unanswered probe
+	if sshClientOptions.IsSet("ServerAliveCountMax") {
+		serverAliveCountMax, _ = optionCount(sshClientOptions, "ServerAliveCountMax")
 	}
-	if strictHostChecking {
-		var err error
-		hostKeyChecker, err = knownhosts.New(userKnownHostsFile)
+	upstreamAlgorithms, _ := upstreamConfig(sshClientOptions)
+	listenerAlgorithmConfig, err := listenerConfig(listenCiphers, listenKexAlgorithms, listenMACs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	hostKeyAlgorithms, err := listenerAlgorithms("HostKeyAlgorithms", listenHostKeyAlgorithms)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	agentForward = agentForward || truthy(sshClientOptions.Get("ForwardAgent"))
+	x11Forward = x11Forward || truthy(sshClientOptions.Get("ForwardX11"))
+
+	// clients authenticating to the proxy itself
+	var clientKeyChecker sshproxy.ClientKeyChecker
+	if authorizedKeys != "" || len(userCAs) > 0 {
+		var caKeys []ssh.PublicKey
+		for _, userCA := range userCAs {
+			keys, err := sshproxy.LoadPublicKeys(userCA)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			caKeys = append(caKeys, keys...)
+		}
+		checker, err := sshproxy.AuthorizedKeys(authorizedKeys, caKeys)
 		if err != nil {
-			panic(err)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
+		clientKeyChecker = checker
+	} else if requireClientKey {
+		fmt.Fprintln(os.Stderr, "-requireClientKey needs -authorizedKeys or -userCA")
+		os.Exit(2)
+	}
+	switch lendCredentials {
+	case "":
+		if clientKeyChecker != nil {
+			lendCredentials = "verified"
+		} else {
+			lendCredentials = "anyone"
+		}
+	case "verified":
+		if clientKeyChecker == nil {
+			fmt.Fprintln(os.Stderr, "-lendCredentials=verified needs -authorizedKeys or -userCA")
+			os.Exit(2)
+		}
+	case "anyone":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -lendCredentials %q (expected verified or anyone)\n", lendCredentials)
+		os.Exit(2)
 	}
 
-	// detect between 3 different modes of identity key files:
-	// - none provided: use default of $HOME/.ssh/id_rsa and $HOME/.ssh/id_ed25519 (if $HOME exists)
-	// - one provided equal to /dev/null: empty out the array (don't use any identity files)
-	// - else: specifies a set of identity files to use (if not already in client's agent), in attempt order
-	sshIdentitiesSet := map[string]string{}
-	var sshIdentities []string
-	if len(identityArgs) == 0 {
-		defaultIdentities := []string{"/.ssh/id_rsa", "/.ssh/id_ed25519"}
+	switch keyUnlock {
+	case "shared":
+	case "user":
+		unlock.perUser = true
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -keyUnlock %q (expected shared or user)\n", keyUnlock)
+		os.Exit(2)
+	}
+
+	// jump hosts from -J, or otherwise the ProxyJump option
+	if sshClientOptions.IsSet("ProxyJump") && jumpHosts == "" {
+		jumpHosts = sshClientOptions.Get("ProxyJump")
+	}
+	jumps, err := sshproxy.ParseJumpHosts(jumpHosts, 22)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// default to checking known hosts from $HOME/.ssh/known_hosts(2), and the system-wide files
+	userKnownHostsFiles := "~/.ssh/known_hosts ~/.ssh/known_hosts2"
+	globalKnownHostsFiles := "/etc/ssh/ssh_known_hosts /etc/ssh/ssh_known_hosts2"
+	// unless overridden by the client
+	if sshClientOptions.IsSet("UserKnownHostsFile") {
+		userKnownHostsFiles = sshClientOptions.Get("UserKnownHostsFile")
+	}
+	if sshClientOptions.IsSet("GlobalKnownHostsFile") {
+		globalKnownHostsFiles = sshClientOptions.Get("GlobalKnownHostsFile")
+	}
+	knownHostsFiles := func(files string) []string {
+		var paths []string
+		for _, file := range strings.Fields(files) {
+			if !strings.EqualFold(file, "none") {
+				paths = append(paths, sshClientOptions.Expand(file))
+			}
+		}
+		return paths
+	}
+
+	// default to asking the downstream user about unknown host keys, as the OpenSSH client does
+	policy := hostcheck.Ask
+	if sshClientOptions.IsSet("StrictHostKeyChecking") {
+		policy, _ = hostcheck.ParsePolicy(sshClientOptions.Get("StrictHostKeyChecking"))
+	}
+	hostKeyChecker := &hostcheck.Checker{
+		KnownHostsFiles:       knownHostsFiles(userKnownHostsFiles),
+		GlobalKnownHostsFiles: knownHostsFiles(globalKnownHostsFiles),
+		Policy:                policy,
+		HashKnownHosts:        truthy(sshClientOptions.Get("HashKnownHosts")),
+		HostKeyAlias:          sshClientOptions.Get("HostKeyAlias"),
+		CheckHostIP:           truthy(sshClientOptions.Get("CheckHostIP")),
+		Logger:                log.New(os.Stderr, "", log.LstdFlags),
+	}
+	if policy != hostcheck.Off && len(hostKeyChecker.KnownHostsFiles) == 0 {
+		// asked for host key checking, but no known hosts file... die
+		fmt.Fprintln(os.Stderr, "Host key checking enabled, but no known_hosts file provided")
+		os.Exit(2)
+	}
+	hostKeyChecker.Algorithms, _ = sshClientOptions.Algorithms("HostKeyAlgorithms")
+
+	// identity files (from -i, or IdentityFile options) in attempt order; by default, those of the OpenSSH client's
+	// default identity files that exist. "IdentityFile none" (or -i /dev/null) uses no identity files.
+	var identityFiles []string
+	if !sshClientOptions.IsSet("IdentityFile") {
 		if home, ok := os.LookupEnv("HOME"); ok {
-			for _, identity := range defaultIdentities {
-				fn := home + identity
-				if _, err := os.Stat(fn); !os.IsNotExist(err) {
-					if _, exists := sshIdentitiesSet[fn]; !exists {
-						sshIdentitiesSet[fn] = fn
-						sshIdentities = append(sshIdentities, fn)
-					}
+			for _, name := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+				fn := filepath.Join(home, ".ssh", name)
+				if _, err := os.Stat(fn); err == nil {
+					identityFiles = append(identityFiles, fn)
 				}
 			}
 		}
 	} else {
-		for _, fn := range identityArgs {
-			if _, err := os.Stat(fn); !os.IsNotExist(err) {
-				if _, exists := sshIdentitiesSet[fn]; !exists {
-					sshIdentitiesSet[fn] = fn
-					sshIdentities = append(sshIdentities, fn)
-				}
+		for _, fn := range sshClientOptions.IdentityFiles() {
+			if fn != os.DevNull {
+				identityFiles = append(identityFiles, fn)
 			}
 		}
 	}
-	if len(sshIdentities) == 1 && sshIdentities[0] == "/dev/null" {
-		sshIdentities = nil
-	}
 
 	authMethods := sshproxy.DefaultAuthMethods
-	var extraQuestions chan *sshproxy.ProxiedAuthQuestion
 	if !dumbAuth {
+		identities, problems := identity.LoadAll(identityFiles)
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", problem)
+		}
+
 		var signers []ssh.Signer
-		keySet := map[string]string{}
-		// keys from the agent
+		keySet := map[string]ssh.Signer{} // by the marshaled public key (or certificate)
+		addSigner := func(signer ssh.Signer) {
+			if keyID := identity.KeyID(signer.PublicKey()); keySet[keyID] == nil {
+				signers = append(signers, signer)
+				keySet[keyID] = signer
+			}
+		}
+		// keys from identities; passphrase protected keys ask for their passphrase when first needed to sign (via
+		// session questions)
+		for _, id := range identities {
+			if !id.Encrypted() {
+				addSigner(id.Signer)
+				continue
+			}
+			addSigner(&boundSigner{deferred: newDeferredSigner(id, &unlock)})
+		}
+
+		// keys from the agents, listed anew for each authentication; with IdentitiesOnly, only those that are also
+		// identity files
+		agents := &agentKeys{
+			identitiesOnly: truthy(sshClientOptions.Get("IdentitiesOnly")),
+			identities:     identities,
+			logger:         log.New(os.Stderr, "", log.LstdFlags),
+		}
 		if !disableAgent {
-			if agentSocket, ok := os.LookupEnv("SSH_AUTH_SOCK"); ok {
-				if agentConn, err := net.Dial("unix", agentSocket); err == nil {
-					sshAgent := agent.NewClient(agentConn)
-					if agentSigners, err := sshAgent.Signers(); err == nil {
-						for _, agentSigner := range agentSigners {
-							publicKeyIdentity := fmt.Sprintf("%x", agentSigner.PublicKey().Marshal())
-							if _, present := keySet[publicKeyIdentity]; !present {
-								signers = append(signers, agentSigner)
-								keySet[publicKeyIdentity] = publicKeyIdentity
-							}
-						}
-					}
+			agents.sockets = sshClientOptions.IdentityAgents()
+		}
+
+		// certificates are offered before plain keys: those held by the agents, then certificate files (from
+		// CertificateFile options, and "<identity>-cert.pub" beside each identity file) for the identities loaded
+		// above, or otherwise for agent keys
+		certFiles := sshClientOptions.CertificateFiles()
+		configuredCerts := len(certFiles)
+		for _, identityFile := range identityFiles {
+			certFiles = append(certFiles, identityFile+"-cert.pub")
+		}
+		certFilesSeen := map[string]bool{}
+		for idx, certFile := range certFiles {
+			if certFilesSeen[certFile] {
+				continue
+			}
+			certFilesSeen[certFile] = true
+			cert, err := identity.LoadCertificate(certFile)
+			if err != nil {
+				if idx < configuredCerts || !os.IsNotExist(err) {
+					fmt.Fprintf(os.Stderr, "Warning: certificate %s: %v\n", certFile, err)
+				}
+				continue
+			}
+			signer, found := keySet[identity.KeyID(cert.Key)]
+			if !found {
+				if len(agents.sockets) == 0 {
+					fmt.Fprintf(os.Stderr, "Warning: certificate %s: no identity holds its private key\n", certFile)
 				}
+				agents.certs = append(agents.certs, cert)
+				continue
 			}
+			var certSigner ssh.Signer
+			if deferred, ok := signer.(*boundSigner); ok {
+				certSigner = &boundSigner{deferred: deferred.deferred, cert: cert}
+			} else if certSigner, err = ssh.NewCertSigner(cert, signer); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: certificate %s: %v\n", certFile, err)
+				continue
+			}
+			addSigner(certSigner)
 		}
-		// keys from identities -- might be password protected
-		extraQuestions = make(chan *sshproxy.ProxiedAuthQuestion)
-		for _, sshIdentity := range sshIdentities {
-			if keyBytes, err := os.ReadFile(sshIdentity); err == nil {
-				if signer, err := ssh.ParsePrivateKey(keyBytes); err == nil {
-					// unencrypted private key
-					publicKeyIdentity := fmt.Sprintf("%x", signer.PublicKey().Marshal())
-					if _, present := keySet[publicKeyIdentity]; !present {
-						signers = append(signers, signer)
-						keySet[publicKeyIdentity] = publicKeyIdentity
+		signers = identity.CertificatesFirst(signers)
+
+		authMethods = func(session *sshproxy.Session) []ssh.AuthMethod {
+			var methods []ssh.AuthMethod
+			// certificates are offered first, and otherwise keys from the client's own forwarded agent before the
+			// proxy's; the proxy's own keys are only lent to clients permitted to use them
+			lend := lendCredentials == "anyone" || session.Verified()
+			if optionEnabled(sshClientOptions, "PubkeyAuthentication") && (lend || session.ClientAgent() != nil) {
+				methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+					sessionSigners := session.ClientAgentSigners()
+					if !lend {
+						return identity.CertificatesFirst(sessionSigners), nil
 					}
-				} else if err.Error() == "ssh: cannot decode encrypted private keys" {
-					// XXX: Brittle hack -- no dedicated sentinel error for private key decoding in SSH library.
-					// create a deferred key, and ask for a password when asked to sign with it (via extra questions)
-					if pubKeyBytes, err := os.ReadFile(sshIdentity + ".pub"); err == nil {
-						if pubKey, _, _, _, err := ssh.ParseAuthorizedKey(pubKeyBytes); err == nil {
-							publicKeyIdentity := fmt.Sprintf("%x", pubKey.Marshal())
-							if _, present := keySet[publicKeyIdentity]; !present {
-								signers = append(signers, &deferredSigner{
-									internPub: pubKey,
-									force: func(ds *deferredSigner) error {
-										answer := make(chan error, 1)
-										extraQuestions <- &sshproxy.ProxiedAuthQuestion{
-											Message: fmt.Sprintf("Enter password for '%s'", sshIdentity),
-											Prompt:  "Password: ",
-											Echo:    false,
-											OnAnswer: func(password string) bool {
-												if decryptedSigner, err := ssh.ParsePrivateKeyWithPassphrase(keyBytes,
-													[]byte(password)); err == nil {
-													ds.actual = decryptedSigner
-													close(answer)
-													return true
-												} else {
-													answer <- err
-													return false
-												}
-											},
-										}
-										return <-answer
-									},
-								})
-								keySet[publicKeyIdentity] = publicKeyIdentity
+					sessionSigners = append(sessionSigners, agents.signers(session)...)
+					held := map[string]ssh.Signer{} // keys held by agents, which identities need not duplicate
+					for _, signer := range sessionSigners {
+						held[identity.KeyID(signer.PublicKey())] = signer
+					}
+					for _, signer := range signers {
+						if held[identity.KeyID(signer.PublicKey())] != nil {
+							continue
+						}
+						// deferred signers ask this session's user for passphrases, unless an agent holds the key
+						if deferred, ok := signer.(*boundSigner); ok {
+							if agentSigner := held[identity.KeyID(deferred.deferred.PublicKey())]; agentSigner != nil {
+								if certSigner, err := ssh.NewCertSigner(deferred.cert, agentSigner); err == nil {
+									sessionSigners = append(sessionSigners, certSigner)
+									continue
+								}
 							}
+							signer = deferred.bind(session)
 						}
+						sessionSigners = append(sessionSigners, signer)
 					}
-				}
+					return identity.CertificatesFirst(sessionSigners), nil
+				}))
 			}
-		}
-
-		authMethods = []ssh.AuthMethod{
-			ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
-				return signers, nil
-			}),
-			ssh.KeyboardInteractive(func(_, instruction string, questions []string, echos []bool) ([]string, error) {
+			// as with the OpenSSH client, no secrets are sent to a target whose changed host key was accepted
+			keyboardInteractive := func(_, instruction string, questions []string, echos []bool) ([]string, error) {
+				if session.HostKeyChanged() {
+					return nil, sshproxy.ErrHostKeyChanged
+				}
 				var answers []string
 				answer := make(chan string, 1)
 				for idx, question := range questions {
 					echo := echos[idx]
-					extraQuestions <- &sshproxy.ProxiedAuthQuestion{
+					err := session.Ask(&sshproxy.ProxiedAuthQuestion{
 						Message: instruction,
 						Prompt:  question,
 						Echo:    echo,
@@ -268,41 +541,207 @@ func main() {
 							answer <- response
 							return true
 						},
+					})
+					if err != nil {
+						return nil, err
 					}
 					answers = append(answers, <-answer)
 				}
 				return answers, nil
-			}),
-			ssh.PasswordCallback(func() (string, error) {
+			}
+			password := func() (string, error) {
+				if session.HostKeyChanged() {
+					return "", sshproxy.ErrHostKeyChanged
+				}
 				passwd := make(chan string, 1)
-				extraQuestions <- &sshproxy.ProxiedAuthQuestion{
+				err := session.Ask(&sshproxy.ProxiedAuthQuestion{
 					Prompt: "[*] Password: ",
 					Echo:   false,
 					OnAnswer: func(password string) bool {
 						passwd <- password
 						return true
 					},
+				})
+				if err != nil {
+					return "", err
 				}
 				return <-passwd, nil
-			}),
+			}
+			if optionEnabled(sshClientOptions, "KbdInteractiveAuthentication") {
+				methods = append(methods, ssh.KeyboardInteractive(keyboardInteractive))
+			}
+			if optionEnabled(sshClientOptions, "PasswordAuthentication") {
+				methods = append(methods, ssh.PasswordCallback(password))
+			}
+			return methods
 		}
 	}
 
+	// in stdio mode, stdout carries the SSH connection itself; informational output goes to stderr instead
+	var output io.Writer = os.Stdout
+	if stdio {
+		output = os.Stderr
+	}
+
 	if printPredictiveVersion {
 		if noPrediction {
-			fmt.Println("Predictive Backend *DISABLED*")
+			fmt.Fprintln(output, "Predictive Backend *DISABLED*")
 		} else {
-			fmt.Printf("Predictive Backend Version: %v\n", predictive.GetVersion())
+			fmt.Fprintf(output, "Predictive Backend Version: %v\n", predictive.GetVersion())
 		}
 		if fakeDelay > 0 {
-			fmt.Printf("Aritifical Added Latency: %v\n", fakeDelay)
+			fmt.Fprintf(output, "Aritifical Added Latency: %v\n", fakeDelay)
+		}
+	}
+
+	// persistent host keys, so that clients can recognize the proxy across restarts
+	keyProvider := sshproxy.EphemeralHostKey
+	if len(hostKeyFiles) == 0 {
+		if home, ok := os.LookupEnv("HOME"); ok {
+			hostKeyFiles = append(hostKeyFiles, home+"/.ssh/nosshtradamus_host_ed25519_key")
+		}
+	}
+	if len(hostKeyFiles) > 0 {
+		keyProvider = sshproxy.HostKeyFiles(hostKeyFiles, true)
+	}
+	// derived host keys, for the static target and for each listener with a target of its own
+	listenKeyProviders := map[string]sshproxy.HostKeyProvider{} // by listen address, defaulting to keyProvider
+	if hostKeySecret != "" {
+		// the target must be known before key exchange, when the client has yet to send a username (which names the
+		// target with -targetFromUser); nor does SSH let the client name the host it expects, as TLS's SNI does
+		if (targetFromUser || target == "") && len(listenTargets) == 0 {
+			fmt.Fprintln(os.Stderr, "-hostKeySecret requires a static -target, or -listen addresses with targets of "+
+				"their own (host keys are presented before the username naming a -targetFromUser target is sent)")
+			os.Exit(2)
+		}
+		secret, err := sshproxy.LoadHostKeySecret(hostKeySecret)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !targetFromUser && target != "" {
+			keyProvider = sshproxy.DerivedHostKey(secret, target)
+		}
+		for listenAddr, listenTarget := range listenTargets {
+			listenKeyProviders[listenAddr] = sshproxy.DerivedHostKey(secret, listenTarget)
 		}
 	}
+	if printHostKey {
+		printKeys := func(names []string, provider sshproxy.HostKeyProvider) {
+			hostKeys, err := provider()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			for _, hostKey := range hostKeys {
+				// a certificate is trusted through its authority rather than as a key (its plain key is printed as well)
+				if cert, ok := hostKey.PublicKey().(*ssh.Certificate); ok {
+					fmt.Printf("# host certificate %s, to be trusted with its authority:\n",
+						ssh.FingerprintSHA256(cert.Key))
+					fmt.Println("# @cert-authority " + knownhosts.Line(names, cert.SignatureKey))
+					continue
+				}
+				fmt.Println(knownhosts.Line(names, hostKey.PublicKey()))
+			}
+		}
 
-	if port == 0 || target == "" {
+		var names []string
+		derivedNames := map[string]string{} // names of listeners presenting keys of their own, by listen address
+		if stdio {
+			names = append(names, knownhosts.Normalize(target))
+		} else if port != 0 {
+			// -port listens on both loopback addresses, which clients may name as well as localhost
+			for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+				names = append(names, knownhosts.Normalize(net.JoinHostPort(host, strconv.Itoa(port))))
+			}
+		}
+		for _, listenAddr := range listenAddrs {
+			host, listenPort, err := net.SplitHostPort(listenAddr)
+			if err != nil {
+				continue // not a TCP address
+			}
+			if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+				if host, err = os.Hostname(); err != nil {
+					continue
+				}
+			}
+			name := knownhosts.Normalize(net.JoinHostPort(host, listenPort))
+			if listenKeyProviders[listenAddr] != nil {
+				derivedNames[listenAddr] = name
+			} else {
+				names = append(names, name)
+			}
+		}
+		if (len(names) == 0 && len(derivedNames) == 0) || (len(names) > 0 && names[0] == "") {
+			fmt.Fprintln(os.Stderr, "-printHostKey needs the address clients connect to (-port, -listen, or -stdio -target)")
+			os.Exit(2)
+		}
+		if len(names) > 0 {
+			printKeys(names, keyProvider)
+		}
+		for _, listenAddr := range listenAddrs {
+			if name, derived := derivedNames[listenAddr]; derived {
+				fmt.Printf("# %s, proxying to %s:\n", listenAddr, listenTargets[listenAddr])
+				printKeys([]string{name}, listenKeyProviders[listenAddr])
+			}
+		}
+		return
+	}
+
+	// sockets passed by systemd socket activation are always served, as well as any explicitly specified
+	var listeners []net.Listener
+	if !stdio {
+		if listeners, err = sshproxy.SystemdListeners(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if port != 0 {
+			listenAddrs = append(listenAddrs, fmt.Sprintf("127.0.0.1:%d", port), fmt.Sprintf("[::1]:%d", port))
+		}
+	} else if port != 0 || len(listenAddrs) > 0 {
+		fmt.Fprintln(os.Stderr, "-stdio cannot be combined with -port or -listen")
+		os.Exit(2)
+	}
+	// sockets passed by systemd (and -port) have no targets of their own
+	untargeted := stdio || len(listeners) > 0
+	for _, listenAddr := range listenAddrs {
+		untargeted = untargeted || listenTargets[listenAddr] == ""
+	}
+	if (!stdio && len(listeners) == 0 && len(listenAddrs) == 0) || (untargeted && target == "" && !targetFromUser) {
 		flag.Usage()
 		return
 	}
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -socketMode %q\n", socketMode)
+		os.Exit(2)
+	}
+	routes := make([]*sshproxy.Route, len(listeners))
+	for idx, listener := range listeners {
+		routes[idx] = &sshproxy.Route{Listener: listener}
+	}
+	routeTargets := map[*sshproxy.Route]string{}
+	for _, listenAddr := range listenAddrs {
+		listener, err := sshproxy.Listen(listenAddr, os.FileMode(mode))
+		if err != nil {
+			if listenAddr == fmt.Sprintf("[::1]:%d", port) {
+				continue // IPv6 loopback may be unavailable
+			}
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		route := &sshproxy.Route{Listener: listener, KeyProvider: listenKeyProviders[listenAddr]}
+		routeTargets[route] = listenTargets[listenAddr]
+		routes = append(routes, route)
+	}
+	if targetFromUser && len(allowTargets) == 0 {
+		fmt.Fprintln(os.Stderr, "-targetFromUser requires at least one -allowTarget pattern")
+		os.Exit(2)
+	}
+	if lendCredentials == "anyone" && !dumbAuth && !stdio {
+		fmt.Fprintln(os.Stderr, "Warning: any client able to connect to the proxy may authenticate to the target "+
+			"with the proxy's agent and identity keys (see -authorizedKeys)")
+	}
 
 	var filter sshproxy.ChannelStreamFilter
 	if !noPrediction || fakeDelay > 0 {
@@ -332,7 +771,7 @@ func main() {
 							interposer = predictive.Interpose(wrapped, func(interposer *predictive.Interposer,
 								epoch uint64, openedAt time.Time) {
 								if printTiming {
-									fmt.Printf("Ping %d\n", epoch)
+									fmt.Fprintf(output, "Ping %d\n", epoch)
 								}
 								if fakeDelay > 0 {
 									time.Sleep(fakeDelay)
@@ -341,7 +780,7 @@ func main() {
 									true, nil)
 
 								if printTiming {
-									fmt.Printf("Pong %d - (%v)\n", epoch, time.Now().Sub(openedAt))
+									fmt.Fprintf(output, "Pong %d - (%v)\n", epoch, time.Now().Sub(openedAt))
 								}
 								time.Sleep(time.Second / 60) // delay closing of the epoch by one frame (???)
 								interposer.CloseEpoch(epoch, openedAt)
@@ -441,31 +880,126 @@ func main() {
 		}
 	}
 
-	if addr, err := net.ResolveTCPAddr("tcp", target); err != nil {
-		panic(err)
-	} else {
-		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-		if err != nil {
-			panic(err)
+	// a static target keeps its name (rather than the address it resolved to), which its host key is looked up under
+	staticTarget := func(address string) sshproxy.TargetResolver {
+		resolver := sshproxy.StaticHostTarget(address)
+		// a configured User replaces the downstream username, as it would for the OpenSSH client
+		upstreamUser := sshClientOptions.User()
+		if upstreamUser == "" {
+			return resolver
 		}
-		banner := func(conn ssh.ConnMetadata) string {
-			return fmt.Sprintf("Nosshtradamus proxying ~ %s@%v\n", conn.User(), target)
+		return func(conn ssh.ConnMetadata) (*sshproxy.Target, error) {
+			resolved, err := resolver(conn)
+			if err == nil {
+				resolved.User = upstreamUser
+			}
+			return resolved, err
 		}
+	}
+	bannerFor := func(resolver sshproxy.TargetResolver) func(conn ssh.ConnMetadata) string {
 		if noBanner {
-			banner = nil
-		}
-		err = sshproxy.RunProxy(listener, addr, &sshproxy.ProxyConfig{
-			KeyProvider:      sshproxy.GenHostKey,
-			TargetKeyChecker: hostKeyChecker,
-			ChannelFilter:    filter,
-			AuthMethods:      authMethods,
-			Banner:           banner,
-			ReportAuthErr:    authErrDetails,
-			ExtraQuestions:   extraQuestions,
-			BlockAgent:       !agentForward,
-		})
-		if err != nil {
-			panic(err)
+			return nil
+		}
+		return func(conn ssh.ConnMetadata) string {
+			if resolved, err := resolver(conn); err == nil {
+				return fmt.Sprintf("Nosshtradamus proxying ~ %s\n", resolved)
+			}
+			return fmt.Sprintf("Nosshtradamus proxying ~ %s\n", conn.User())
 		}
 	}
+	var resolver sshproxy.TargetResolver
+	if targetFromUser {
+		resolver = sshproxy.UserEncodedTargets(allowTargets, 22)
+	} else if target == "" {
+		// every listener has a target of its own
+		resolver = func(_ ssh.ConnMetadata) (*sshproxy.Target, error) {
+			return nil, errors.New("no target for this listener")
+		}
+	} else if _, err := net.ResolveTCPAddr("tcp", target); err != nil {
+		fmt.Fprintf(os.Stderr, "target %s: %v\n", target, err)
+		os.Exit(1)
+	} else {
+		resolver = staticTarget(target)
+	}
+	for route, routeTarget := range routeTargets {
+		if routeTarget != "" {
+			route.TargetResolver = staticTarget(routeTarget)
+			route.Banner = bannerFor(route.TargetResolver)
+		}
+	}
+	proxy, err := sshproxy.NewProxy(nil, &sshproxy.ProxyConfig{
+		KeyProvider:         keyProvider,
+		TargetKeyChecker:    hostKeyChecker.Callback,
+		TargetKeyAlgorithms: hostKeyChecker.HostKeyAlgorithms,
+		ChannelFilter:       filter,
+		AuthMethods:         authMethods,
+		Banner:              bannerFor(resolver),
+		ReportAuthErr:       authErrDetails,
+		BlockAgent:          !agentForward,
+		ClientAgentAuth:     clientAgent,
+		BlockX11:            !x11Forward,
+		SpoofX11Cookie:      x11SpoofCookie,
+		TargetResolver:      resolver,
+		UpstreamDialer:      sshproxy.JumpDialer(jumps, nil),
+		ConnectTimeout:      connectTimeout,
+		UpstreamConfig:      upstreamAlgorithms,
+		DownstreamConfig:    listenerAlgorithmConfig,
+		HostKeyAlgorithms:   hostKeyAlgorithms,
+		LogAlgorithms:       logAlgorithms,
+		Logger:              log.New(os.Stderr, "", log.LstdFlags),
+
+		ServerAliveInterval: serverAliveInterval,
+		ServerAliveCountMax: serverAliveCountMax,
+		ClientAliveInterval: clientAliveInterval,
+		ClientAliveCountMax: clientAliveCountMax,
+
+		ClientKeyChecker: clientKeyChecker,
+		RequireClientKey: requireClientKey,
+
+		HandshakeTimeout:   handshakeTimeout,
+		AuthTimeout:        authTimeout,
+		MaxUnauthenticated: maxUnauthenticated,
+		AuthRatePerMinute:  authRate,
+		AuthRateBurst:      authBurst,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// as a ProxyCommand, the process serves the one session on stdin/stdout, and exits when it ends
+	if stdio {
+		if err := proxy.ServeConn(sshproxy.StdioConn(os.Stdin, os.Stdout)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// on SIGINT/SIGTERM, stop accepting connections and let open sessions finish; a second signal (or the drain
+	// timeout expiring) closes whatever sessions remain
+	shutdownComplete := make(chan interface{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "Shutting down; waiting for open sessions to finish...")
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		go func() {
+			select {
+			case <-signals:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		_ = proxy.Shutdown(ctx)
+		close(shutdownComplete)
+	}()
+
+	err = proxy.ServeRoutes(context.Background(), routes)
+	if err != sshproxy.ErrProxyClosed {
+		panic(err)
+	}
+	<-shutdownComplete
 }
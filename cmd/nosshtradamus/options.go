@@ -0,0 +1,298 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"nosshtradamus/internal/hostcheck"
+	"nosshtradamus/internal/sshconfig"
+	"nosshtradamus/internal/sshproxy"
+
+	"golang.org/x/crypto/ssh"
+
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// supportedOptions are the SSH client options the proxy honors (from -o, or the SSH client configuration files), with
+// a check of each option's value. Other options may appear in configuration files, but have no effect.
+var supportedOptions = map[string]func(settings *sshconfig.Settings, keyword string) error{
+	"CertificateFile":              anyOption,
+	"CheckHostIP":                  yesNoOption,
+	"Ciphers":                      algorithmsOption,
+	"ConnectTimeout":               durationOption,
+	"ForwardAgent":                 yesNoOption,
+	"ForwardX11":                   yesNoOption,
+	"GlobalKnownHostsFile":         anyOption,
+	"HashKnownHosts":               yesNoOption,
+	"HostKeyAlgorithms":            algorithmsOption,
+	"HostKeyAlias":                 anyOption,
+	"HostName":                     anyOption,
+	"IdentitiesOnly":               yesNoOption,
+	"IdentityAgent":                anyOption,
+	"IdentityFile":                 anyOption,
+	"KbdInteractiveAuthentication": yesNoOption,
+	"KexAlgorithms":                algorithmsOption,
+	"MACs":                         algorithmsOption,
+	"PasswordAuthentication":       yesNoOption,
+	"Port":                         portOption,
+	"ProxyJump":                    proxyJumpOption,
+	"PubkeyAuthentication":         yesNoOption,
+	"RekeyLimit":                   rekeyLimitOption,
+	"ServerAliveCountMax":          countOption,
+	"ServerAliveInterval":          durationOption,
+	"StrictHostKeyChecking":        strictHostKeyCheckingOption,
+	"User":                         anyOption,
+	"UserKnownHostsFile":           anyOption,
+}
+
+// parseOptionArg sets an option given on the command line as "Keyword=value" (or "Keyword value"). Options that are
+// unknown, or not supported by the proxy, are refused.
+func parseOptionArg(settings *sshconfig.Settings, option string) error {
+	name, args, err := sshconfig.ParseOption(option)
+	if err != nil {
+		return fmt.Errorf("-o %q: %w", option, err)
+	}
+	keyword, known := sshconfig.Keyword(name)
+	if !known {
+		return fmt.Errorf("-o %q: unknown option %s", option, name)
+	}
+	if _, supported := supportedOptions[keyword]; !supported {
+		return fmt.Errorf("-o %q: option %s is not supported by the proxy", option, keyword)
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("-o %q: missing value for %s", option, keyword)
+	}
+	settings.Set(keyword, args...)
+	return nil
+}
+
+// commandLineSettings starts resolving the options for the target (a host or host alias, with an optional port) with
+// those given on the command line, which take precedence over configuration files: options (-o), then the port of the
+// target (unless -o sets one), and identity files (-i).
+func commandLineSettings(target string, optionArgs, identityArgs []string) (*sshconfig.Settings, error) {
+	targetHost, targetPort, err := net.SplitHostPort(target)
+	if err != nil {
+		targetHost, targetPort = target, ""
+	}
+	settings := sshconfig.NewSettings(targetHost)
+	for _, option := range optionArgs {
+		if err := parseOptionArg(settings, option); err != nil {
+			return nil, err
+		}
+	}
+	if targetPort != "" {
+		settings.Set("Port", targetPort)
+	}
+	for _, identityArg := range identityArgs {
+		settings.Set("IdentityFile", identityArg)
+	}
+	return settings, nil
+}
+
+// checkOptions verifies the values of the supported options that are set.
+func checkOptions(settings *sshconfig.Settings) error {
+	for keyword, check := range supportedOptions {
+		if !settings.IsSet(keyword) {
+			continue
+		}
+		if err := check(settings, keyword); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optionEnabled interprets a yes/no option that defaults to yes.
+func optionEnabled(settings *sshconfig.Settings, keyword string) bool {
+	return !settings.IsSet(keyword) || truthy(settings.Get(keyword))
+}
+
+func anyOption(_ *sshconfig.Settings, _ string) error {
+	return nil
+}
+
+func yesNoOption(settings *sshconfig.Settings, keyword string) error {
+	switch strings.ToLower(settings.Get(keyword)) {
+	case "yes", "no", "true", "false", "1", "0":
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q (expected yes or no)", keyword, settings.Get(keyword))
+}
+
+func durationOption(settings *sshconfig.Settings, keyword string) error {
+	_, err := settings.Duration(keyword)
+	return err
+}
+
+func countOption(settings *sshconfig.Settings, keyword string) error {
+	_, err := optionCount(settings, keyword)
+	return err
+}
+
+// optionCount interprets an option that is a non-negative integer; it is zero if unset.
+func optionCount(settings *sshconfig.Settings, keyword string) (int, error) {
+	if !settings.IsSet(keyword) {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(settings.Get(keyword))
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid %s %q", keyword, settings.Get(keyword))
+	}
+	return count, nil
+}
+
+func portOption(settings *sshconfig.Settings, _ string) error {
+	_, err := settings.Port()
+	return err
+}
+
+func algorithmsOption(settings *sshconfig.Settings, keyword string) error {
+	_, err := settings.Algorithms(keyword)
+	return err
+}
+
+func proxyJumpOption(settings *sshconfig.Settings, keyword string) error {
+	_, err := sshproxy.ParseJumpHosts(settings.Get(keyword), 22)
+	return err
+}
+
+func strictHostKeyCheckingOption(settings *sshconfig.Settings, keyword string) error {
+	_, err := hostcheck.ParsePolicy(settings.Get(keyword))
+	return err
+}
+
+func rekeyLimitOption(settings *sshconfig.Settings, _ string) error {
+	_, err := rekeyThreshold(settings)
+	return err
+}
+
+// rekeyThreshold interprets the data limit of the RekeyLimit option ("default" or "none" for the library default);
+// time based rekeying is not supported by the SSH library.
+func rekeyThreshold(settings *sshconfig.Settings) (uint64, error) {
+	args := settings.Values("RekeyLimit")
+	if len(args) == 0 {
+		return 0, nil
+	}
+	if len(args) > 1 && !strings.EqualFold(args[1], "none") {
+		return 0, fmt.Errorf("RekeyLimit time intervals are not supported")
+	}
+	limit := strings.ToUpper(args[0])
+	if limit == "DEFAULT" || limit == "NONE" {
+		return 0, nil
+	}
+	if limit == "" {
+		return 0, fmt.Errorf("invalid RekeyLimit %q", args[0])
+	}
+	multiplier := uint64(1)
+	switch limit[len(limit)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		limit = limit[:len(limit)-1]
+	}
+	bytes, err := strconv.ParseUint(limit, 10, 64)
+	if err != nil || bytes*multiplier < 16 || bytes*multiplier/multiplier != bytes {
+		return 0, fmt.Errorf("invalid RekeyLimit %q", args[0])
+	}
+	return bytes * multiplier, nil
+}
+
+// targetAddress is the "host:port" address of a target named on the command line (possibly as a host alias): its
+// HostName and Port. As with the OpenSSH client, its host key is looked up in known_hosts under this name, rather than
+// the alias or the address the name resolves to.
+func targetAddress(settings *sshconfig.Settings) string {
+	port, _ := settings.Port()
+	return net.JoinHostPort(settings.HostName(), strconv.Itoa(port))
+}
+
+// upstreamConfig produces the algorithm and rekeying configuration for connections to the target (and jump hosts).
+// Algorithms that are not configured default to OpenSSH's choices, rather than the SSH library's (which include SHA-1
+// based key exchange and truncated MACs).
+func upstreamConfig(settings *sshconfig.Settings) (ssh.Config, error) {
+	var config ssh.Config
+	var err error
+	if config.Ciphers, err = algorithmsOrDefaults(settings, "Ciphers"); err != nil {
+		return config, err
+	}
+	if config.KeyExchanges, err = algorithmsOrDefaults(settings, "KexAlgorithms"); err != nil {
+		return config, err
+	}
+	if config.MACs, err = algorithmsOrDefaults(settings, "MACs"); err != nil {
+		return config, err
+	}
+	config.RekeyThreshold, err = rekeyThreshold(settings)
+	return config, err
+}
+
+func algorithmsOrDefaults(settings *sshconfig.Settings, keyword string) ([]string, error) {
+	algorithms, err := settings.Algorithms(keyword)
+	if algorithms == nil && err == nil {
+		algorithms = sshconfig.DefaultAlgorithms(keyword)
+	}
+	return algorithms, err
+}
+
+// listenerAlgorithms interprets an algorithm list for connections from downstream clients, given in the same format as
+// the corresponding SSH client option. An empty list selects the defaults.
+func listenerAlgorithms(keyword, spec string) ([]string, error) {
+	algorithms := sshconfig.DefaultAlgorithms(keyword)
+	if spec != "" {
+		var err error
+		if algorithms, err = sshconfig.ParseAlgorithms(keyword, spec); err != nil {
+			return nil, err
+		}
+	}
+	if keyword == "KexAlgorithms" {
+		// the SSH library only implements the client side of group exchange
+		var supported []string
+		for _, algorithm := range algorithms {
+			if !strings.HasPrefix(algorithm, "diffie-hellman-group-exchange-") {
+				supported = append(supported, algorithm)
+			} else if spec != "" && !strings.ContainsAny(spec[:1], "+-^") {
+				return nil, fmt.Errorf("%s %s is not supported for downstream clients", keyword, algorithm)
+			}
+		}
+		algorithms = supported
+	}
+	if len(algorithms) == 0 {
+		return nil, fmt.Errorf("no %s left for downstream clients", keyword)
+	}
+	return algorithms, nil
+}
+
+// listenerConfig produces the algorithm configuration for connections from downstream clients.
+func listenerConfig(ciphers, kexAlgorithms, macs string) (ssh.Config, error) {
+	var config ssh.Config
+	var err error
+	if config.Ciphers, err = listenerAlgorithms("Ciphers", ciphers); err != nil {
+		return config, err
+	}
+	if config.KeyExchanges, err = listenerAlgorithms("KexAlgorithms", kexAlgorithms); err != nil {
+		return config, err
+	}
+	config.MACs, err = listenerAlgorithms("MACs", macs)
+	return config, err
+}
@@ -0,0 +1,138 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"nosshtradamus/internal/sshconfig"
+
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRekeyThreshold(t *testing.T) {
+	for _, test := range []struct {
+		args      []string
+		threshold uint64
+		invalid   bool
+	}{
+		{args: nil},
+		{args: []string{""}, invalid: true},
+		{args: []string{"1G"}, threshold: 1 << 30},
+		{args: []string{"512K"}, threshold: 512 << 10},
+		{args: []string{"4096"}, threshold: 4096},
+		{args: []string{"default"}},
+		{args: []string{"none"}},
+		{args: []string{"1G", "none"}, threshold: 1 << 30},
+		{args: []string{"1G", "1h"}, invalid: true},
+		{args: []string{"8"}, invalid: true},
+		{args: []string{"lots"}, invalid: true},
+		{args: []string{"G"}, invalid: true},
+	} {
+		settings := sshconfig.NewSettings("target")
+		if test.args != nil {
+			settings.Set("RekeyLimit", test.args...)
+		}
+		threshold, err := rekeyThreshold(settings)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("RekeyLimit %q: expected an error, got %d", test.args, threshold)
+			}
+			continue
+		}
+		if err != nil || threshold != test.threshold {
+			t.Errorf("RekeyLimit %q: expected %d, got %d (%v)", test.args, test.threshold, threshold, err)
+		}
+	}
+}
+
+func TestCheckOptionsEmptyRekeyLimit(t *testing.T) {
+	settings := sshconfig.NewSettings("target")
+	if err := parseOptionArg(settings, `RekeyLimit=""`); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkOptions(settings); err == nil {
+		t.Fatal("expected an empty RekeyLimit to be refused")
+	}
+}
+
+func TestParseOptionArgRefusesUnknown(t *testing.T) {
+	// options named on the command line are deliberate, so those the proxy can't honor are refused, while in
+	// configuration files they are only warned about
+	for _, option := range []string{"UseKeychain=yes", "ControlMaster=auto", "User"} {
+		if err := parseOptionArg(sshconfig.NewSettings("target"), option); err == nil {
+			t.Errorf("-o %s: expected an error", option)
+		}
+	}
+	if err := parseOptionArg(sshconfig.NewSettings("target"), "User=tester"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTargetAddress(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config")
+	config := "Host web\n  HostName web1.example.internal\n  Port 2200\n" +
+		"Host db\n  HostName %h.example.internal\n" +
+		"Host *\n  User deploy\n"
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshConfig, err := sshconfig.Load(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		target, address string
+	}{
+		{"web", "web1.example.internal:2200"},
+		{"db", "db.example.internal:22"},
+		{"other.example.com", "other.example.com:22"},
+		{"2001:db8::1", "[2001:db8::1]:22"},
+	} {
+		settings := sshconfig.NewSettings(test.target)
+		if err := sshConfig.Apply(settings); err != nil {
+			t.Fatal(err)
+		}
+		if address := targetAddress(settings); address != test.address {
+			t.Errorf("target %s: expected %s, got %s", test.target, test.address, address)
+		}
+	}
+}
+
+func TestCommandLineSettingsPort(t *testing.T) {
+	for _, test := range []struct {
+		target  string
+		options []string
+		port    int
+	}{
+		{"web", nil, 22},
+		{"web:2200", nil, 2200},
+		{"web", []string{"Port=2222"}, 2222},
+		{"web:2200", []string{"Port=2222"}, 2222},
+		{"[2001:db8::1]:2200", nil, 2200},
+	} {
+		settings, err := commandLineSettings(test.target, test.options, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port, err := settings.Port(); err != nil || port != test.port {
+			t.Errorf("-target %s %q: expected port %d, got %d (%v)", test.target, test.options, test.port, port, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"nosshtradamus/internal/sshproxy"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// signHostKey implements the "sign-host-key" subcommand: issuing host certificates for the proxy's host keys with a
+// local CA key, written alongside each key as "<key file>-cert.pub" (where the proxy loads them from).
+func signHostKey(args []string) {
+	flags := flag.NewFlagSet("sign-host-key", flag.ExitOnError)
+	caKeyFile := ""
+	principals := ""
+	keyID := ""
+	var validity time.Duration
+	flags.StringVar(&caKeyFile, "ca", "",
+		"CA private key `file` (or its public key, if the private key is held by the SSH agent)")
+	flags.StringVar(&principals, "principals", "", "Comma separated host `names` clients connect to the proxy by")
+	flags.StringVar(&keyID, "id", "nosshtradamus", "Certificate key `identity`")
+	flags.DurationVar(&validity, "validity", 0, "Certificate validity `duration` from now (0 for no expiry)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s sign-host-key -ca file -principals names [options] [host key file...]\n",
+			os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	hostKeyFiles := flags.Args()
+	if len(hostKeyFiles) == 0 {
+		if home, ok := os.LookupEnv("HOME"); ok {
+			hostKeyFiles = []string{home + "/.ssh/nosshtradamus_host_ed25519_key"}
+		}
+	}
+	if caKeyFile == "" || principals == "" || len(hostKeyFiles) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	authority, err := loadCASigner(caKeyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "CA key %s: %v\n", caKeyFile, err)
+		os.Exit(1)
+	}
+	for _, hostKeyFile := range hostKeyFiles {
+		hostKeyFile = strings.TrimSuffix(hostKeyFile, ".pub")
+		hostKey, err := loadPublicKey(hostKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "host key %s: %v\n", hostKeyFile, err)
+			os.Exit(1)
+		}
+		cert, err := sshproxy.SignHostCertificate(authority, hostKey, keyID, strings.Split(principals, ","), validity)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "signing %s: %v\n", hostKeyFile, err)
+			os.Exit(1)
+		}
+		certFile := hostKeyFile + "-cert.pub"
+		if err := os.WriteFile(certFile, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Signed host certificate %s (serial %d) for %s\n", certFile, cert.Serial, principals)
+	}
+}
+
+// loadCASigner loads an unencrypted CA private key, or otherwise finds the CA key in the SSH agent.
+func loadCASigner(path string) (ssh.Signer, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err == nil {
+		return signer, nil
+	}
+	var caKey ssh.PublicKey
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && missing.PublicKey != nil {
+		caKey = missing.PublicKey
+	} else if pub, _, _, _, pubErr := ssh.ParseAuthorizedKey(keyBytes); pubErr == nil {
+		caKey = pub
+	} else if pub, pubErr := loadPublicKey(path); pubErr == nil {
+		caKey = pub
+	} else {
+		return nil, err
+	}
+
+	agentSocket, ok := os.LookupEnv("SSH_AUTH_SOCK")
+	if !ok {
+		return nil, errors.New("key is encrypted, and no SSH agent is available to sign with it")
+	}
+	agentConn, err := net.Dial("unix", agentSocket)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := agent.NewClient(agentConn).Signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, agentSigner := range signers {
+		if bytes.Equal(agentSigner.PublicKey().Marshal(), caKey.Marshal()) {
+			return agentSigner, nil
+		}
+	}
+	return nil, errors.New("key is encrypted, and not loaded in the SSH agent")
+}
+
+// loadPublicKey reads the public key of a private key file, preferring the ".pub" file beside it.
+func loadPublicKey(path string) (ssh.PublicKey, error) {
+	if pubBytes, err := os.ReadFile(path + ".pub"); err == nil {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBytes)
+		return pub, err
+	}
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return signer.PublicKey(), nil
+}
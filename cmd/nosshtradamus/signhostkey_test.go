@@ -0,0 +1,177 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"nosshtradamus/internal/sshproxy"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCAKey writes a new CA key to the directory, encrypted if a passphrase is given, with its ".pub" file.
+func writeCAKey(t *testing.T, dir, name, passphrase string) (ed25519.PrivateKey, string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return key, path
+}
+
+// runAgent serves an SSH agent holding the keys, setting SSH_AUTH_SOCK to it for the test.
+func runAgent(t *testing.T, keys ...ed25519.PrivateKey) {
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socketPath)
+}
+
+func TestLoadCASigner(t *testing.T) {
+	dir := t.TempDir()
+	plainKey, plainPath := writeCAKey(t, dir, "plain_ca", "")
+	encryptedKey, encryptedPath := writeCAKey(t, dir, "encrypted_ca", "correct horse")
+	expectSigner := func(path string, key ed25519.PrivateKey) {
+		t.Helper()
+		signer, err := loadCASigner(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), mustPublicKey(t, key).Marshal()) {
+			t.Errorf("%s: expected the CA's own key", path)
+		}
+	}
+
+	expectSigner(plainPath, plainKey)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_ = os.Unsetenv("SSH_AUTH_SOCK")
+	if _, err := loadCASigner(encryptedPath); err == nil || !strings.Contains(err.Error(), "no SSH agent") {
+		t.Errorf("expected an encrypted key to need an agent, got %v", err)
+	}
+
+	// an encrypted key (or its public key) is signed with by the agent, if it holds the key
+	runAgent(t, plainKey)
+	if _, err := loadCASigner(encryptedPath); err == nil || !strings.Contains(err.Error(), "not loaded") {
+		t.Errorf("expected an encrypted key missing from the agent to be refused, got %v", err)
+	}
+	runAgent(t, plainKey, encryptedKey)
+	expectSigner(encryptedPath, encryptedKey)
+	expectSigner(encryptedPath+".pub", encryptedKey)
+
+	// the agent's signature makes a certificate clients accept
+	signer, err := loadCASigner(encryptedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := sshproxy.GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := sshproxy.SignHostCertificate(signer, hostKey.PublicKey(), "proxy", []string{"proxy"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := &ssh.CertChecker{IsHostAuthority: func(key ssh.PublicKey, _ string) bool {
+		return bytes.Equal(key.Marshal(), signer.PublicKey().Marshal())
+	}}
+	if err := checker.CheckHostKey("proxy:22", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}, cert); err != nil {
+		t.Errorf("expected the agent signed certificate to be accepted: %v", err)
+	}
+}
+
+func mustPublicKey(t *testing.T, key ed25519.PrivateKey) ssh.PublicKey {
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey
+}
+
+func TestLoadPublicKey(t *testing.T) {
+	dir := t.TempDir()
+	key, path := writeCAKey(t, dir, "ssh_host_ed25519_key", "")
+	for _, removePub := range []bool{false, true} {
+		if removePub {
+			// without the ".pub" file, the public key is read from the private key
+			if err := os.Remove(path + ".pub"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pub, err := loadPublicKey(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(pub.Marshal(), mustPublicKey(t, key).Marshal()) {
+			t.Errorf("expected the host key's public key (without .pub: %v)", removePub)
+		}
+	}
+	if _, err := loadPublicKey(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected a missing key to be reported")
+	}
+}
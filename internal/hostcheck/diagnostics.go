@@ -0,0 +1,119 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hostcheck
+
+import (
+	"nosshtradamus/internal/sshproxy"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"fmt"
+	"strings"
+)
+
+// Host key verification failures are explained to the downstream user much as the OpenSSH client would explain them,
+// since the user would otherwise only see a generic authentication failure. The same explanation is logged.
+
+const warningBorder = "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@\n"
+
+// report shows an explanation to the downstream user (without expecting an answer), and logs it.
+func (c *Checker) report(session *sshproxy.Session, message string) {
+	c.logf("%s: %s", session.RemoteAddr(), strings.ReplaceAll(strings.TrimSpace(message), "\n", "\n\t"))
+	_ = session.Ask(&sshproxy.ProxiedAuthQuestion{Message: message})
+}
+
+// mismatchReport explains a host key that differs from the keys on file for the host.
+func mismatchReport(hostname string, key ssh.PublicKey, want []knownhosts.KnownKey, proceeding bool) string {
+	var report strings.Builder
+	report.WriteString(warningBorder)
+	report.WriteString("@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @\n")
+	report.WriteString(warningBorder)
+	report.WriteString("IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!\n")
+	report.WriteString("Someone could be eavesdropping on you right now (man-in-the-middle attack)!\n")
+	report.WriteString("It is also possible that a host key has just been changed.\n")
+	fmt.Fprintf(&report, "The fingerprint for the %s key sent by %s (to the proxy) is\n%s.\n", keyTypeName(key),
+		knownhosts.Normalize(hostname), ssh.FingerprintSHA256(key))
+
+	sameType := false
+	report.WriteString("Host keys on file for it at the proxy:\n")
+	for _, known := range want {
+		fmt.Fprintf(&report, "  %s %s (%s:%d)\n", keyTypeName(known.Key), ssh.FingerprintSHA256(known.Key),
+			known.Filename, known.Line)
+		sameType = sameType || known.Key.Type() == key.Type()
+	}
+	if !sameType {
+		fmt.Fprintf(&report, "No %s host key is on file; the host may have been reinstalled, or offers a key type "+
+			"that was not previously used.\n", keyTypeName(key))
+	}
+	if len(want) > 0 {
+		fmt.Fprintf(&report, "If the change is expected, the proxy operator can remove the old entry with:\n"+
+			"  ssh-keygen -f %q -R %q\n", want[0].Filename, knownhosts.Normalize(hostname))
+	}
+	if proceeding {
+		report.WriteString("Strict host key checking is disabled; connecting anyway.\n")
+		report.WriteString("Password and keyboard-interactive authentication are disabled to avoid man-in-the-middle " +
+			"attacks.\n")
+		report.WriteString("Agent forwarding, X11 forwarding and port forwarding are disabled to avoid " +
+			"man-in-the-middle attacks.\n")
+	} else {
+		report.WriteString("Host key verification failed.\n")
+	}
+	return report.String()
+}
+
+// revokedReport explains a host key (or the authority of a host certificate) marked as @revoked.
+func revokedReport(hostname string, key ssh.PublicKey, revoked *knownhosts.RevokedError) string {
+	var report strings.Builder
+	report.WriteString(warningBorder)
+	report.WriteString("@       WARNING: REVOKED HOST KEY DETECTED!               @\n")
+	report.WriteString(warningBorder)
+	fmt.Fprintf(&report, "The %s host key for %s is marked as revoked (%s:%d).\n", keyTypeName(key),
+		knownhosts.Normalize(hostname), revoked.Revoked.Filename, revoked.Revoked.Line)
+	report.WriteString("This could mean that a stolen key is being used to impersonate this host.\n")
+	fmt.Fprintf(&report, "Revoked key fingerprint: %s %s\n", keyTypeName(revoked.Revoked.Key),
+		ssh.FingerprintSHA256(revoked.Revoked.Key))
+	report.WriteString("Host key verification failed.\n")
+	return report.String()
+}
+
+// unknownReport explains that an unknown host key was refused by strict checking.
+func unknownReport(hostname string, key ssh.PublicKey) string {
+	return fmt.Sprintf("No %s host key is known for %s and strict checking is enabled at the proxy.\n"+
+		"The fingerprint for the %s key sent by the host is\n%s.\nHost key verification failed.\n",
+		keyTypeName(key), knownhosts.Normalize(hostname), keyTypeName(key), ssh.FingerprintSHA256(key))
+}
+
+// ipMismatchReport explains that a host's key differs from the key on file for its IP address (CheckHostIP).
+func ipMismatchReport(hostname, address string, key ssh.PublicKey, want []knownhosts.KnownKey, proceeding bool) string {
+	var report strings.Builder
+	fmt.Fprintf(&report, "Warning: the %s host key for %s differs from the key for the IP address %s.\n",
+		keyTypeName(key), knownhosts.Normalize(hostname), knownhosts.Normalize(address))
+	report.WriteString("This could mean that DNS SPOOFING is happening, or the IP address has moved to another host.\n")
+	for _, known := range want {
+		fmt.Fprintf(&report, "Key on file for the address: %s %s (%s:%d)\n", keyTypeName(known.Key),
+			ssh.FingerprintSHA256(known.Key), known.Filename, known.Line)
+	}
+	if proceeding {
+		report.WriteString("The key for the host name matches; connecting anyway.\n")
+	} else {
+		report.WriteString("Host key verification failed.\n")
+	}
+	return report.String()
+}
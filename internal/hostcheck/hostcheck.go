@@ -0,0 +1,347 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package hostcheck verifies the host keys of targets against known_hosts files, following the OpenSSH client's
+// StrictHostKeyChecking policies; questions about unknown keys are relayed to the downstream user.
+package hostcheck
+
+import (
+	"nosshtradamus/internal/sshconfig"
+	"nosshtradamus/internal/sshproxy"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A Policy decides what happens to host keys not (or not correctly) listed in the known_hosts files.
+type Policy int
+
+const (
+	Strict    Policy = iota // refuse unknown and changed host keys ("yes")
+	AcceptNew               // add unknown host keys, refuse changed ones ("accept-new")
+	Ask                     // ask the downstream user whether to add unknown host keys, refuse changed ones ("ask")
+	Off                     // add unknown host keys, and allow changed ones with a warning, restricting the session ("no")
+)
+
+// ParsePolicy interprets a StrictHostKeyChecking option value.
+func ParsePolicy(value string) (Policy, error) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "1":
+		return Strict, nil
+	case "accept-new":
+		return AcceptNew, nil
+	case "ask":
+		return Ask, nil
+	case "no", "off", "false", "0":
+		return Off, nil
+	}
+	return Strict, fmt.Errorf("unsupported StrictHostKeyChecking value %q", value)
+}
+
+// A Checker verifies host keys against a set of known_hosts files. Files that do not exist are treated as empty. Host
+// certificates are verified against the files' @cert-authority entries, and keys (or authorities) marked @revoked are
+// refused.
+type Checker struct {
+	KnownHostsFiles       []string // the first is the user's own file, which newly accepted host keys are added to
+	GlobalKnownHostsFiles []string // system-wide files, which are only read
+	Policy                Policy
+	HashKnownHosts        bool        // hash host names of entries added to the user's known_hosts file
+	HostKeyAlias          string      // name to look up and record the target's host key under, instead of its address
+	CheckHostIP           bool        // also check (and record) the host key under the target's IP address
+	Algorithms            []string    // host key algorithms to offer (nil for OpenSSH's), reordered by HostKeyAlgorithms
+	Logger                *log.Logger // optional destination for accepted and rejected host keys
+
+	mutex    sync.Mutex
+	probeKey ssh.PublicKey
+}
+
+var errVerificationFailed = errors.New("host key verification failed")
+
+// Callback produces the host key callback for a session, which asks its downstream user about unknown keys if the
+// policy calls for it. It satisfies sshproxy.TargetKeyCheckerProvider.
+func (c *Checker) Callback(session *sshproxy.Session) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		name := c.lookupName(session, hostname)
+		changed, err := c.verify(session, name, remote, key)
+		if changed {
+			session.AcceptChangedHostKey()
+		}
+		if _, isCert := key.(*ssh.Certificate); err == nil && c.CheckHostIP && !isCert && name == hostname {
+			// (as with OpenSSH, not for certificates, or hosts known by an alias)
+			err = c.checkHostIP(session, hostname, remote, key)
+		}
+		return err
+	}
+}
+
+// lookupName is the name a host's keys are looked up under: its address, or for the target, the HostKeyAlias if set.
+func (c *Checker) lookupName(session *sshproxy.Session, hostname string) string {
+	if c.HostKeyAlias != "" && session.Target() != nil && hostname == session.Target().Address {
+		return net.JoinHostPort(c.HostKeyAlias, "22") // aliases are recorded without a port, as OpenSSH does
+	}
+	return hostname
+}
+
+// verify checks the host key against the known_hosts files, applying the policy to unknown and changed keys. A changed
+// key accepted by the policy is reported as such, so that the session can withhold credentials and forwarding from it.
+func (c *Checker) verify(session *sshproxy.Session, hostname string, remote net.Addr,
+	key ssh.PublicKey) (bool, error) {
+	var revoked *knownhosts.RevokedError
+	if cert, ok := key.(*ssh.Certificate); ok {
+		// the SSH library only refuses certificates that are revoked themselves; as OpenSSH does, also refuse those
+		// whose authority or key is revoked
+		for _, revocable := range []ssh.PublicKey{cert.SignatureKey, cert.Key} {
+			if err := c.check(hostname, remote, revocable); errors.As(err, &revoked) {
+				c.report(session, revokedReport(hostname, revocable, revoked))
+				return false, err
+			}
+		}
+	}
+	err := c.check(hostname, remote, key)
+	if err == nil {
+		return false, nil
+	}
+	var keyErr *knownhosts.KeyError
+	if cert, ok := key.(*ssh.Certificate); ok && !errors.As(err, &revoked) && !errors.As(err, &keyErr) {
+		// a certificate not signed by a trusted authority; as OpenSSH does, fall back to its plain host key
+		c.logf("host certificate for %s not accepted (%v); checking its key instead", hostname, err)
+		key = cert.Key
+		if err = c.check(hostname, remote, key); err == nil {
+			return false, nil
+		}
+	}
+	if errors.As(err, &revoked) {
+		c.report(session, revokedReport(hostname, key, revoked))
+		return false, err
+	}
+	if !errors.As(err, &keyErr) {
+		return false, err
+	}
+
+	if len(keyErr.Want) > 0 {
+		// known under a different key
+		c.report(session, mismatchReport(hostname, key, keyErr.Want, c.Policy == Off))
+		if c.Policy == Off {
+			return true, nil
+		}
+		return false, err
+	}
+
+	switch c.Policy {
+	case Strict:
+		c.report(session, unknownReport(hostname, key))
+		return false, fmt.Errorf("no %s host key is known for %s and strict checking is enabled", key.Type(),
+			hostname)
+	case Ask:
+		if !c.confirm(session, hostname, remote, key) {
+			return false, errVerificationFailed
+		}
+	}
+	// as with the OpenSSH client, failing to record the key doesn't prevent this connection
+	if err := c.add(hostname, key); err != nil {
+		c.logf("failed to add the host key for %s to known_hosts: %v", hostname, err)
+	}
+	return false, nil
+}
+
+// checkHostIP checks the (already accepted) host key under the host's IP address too, which detects DNS spoofing. The
+// key is recorded for the address if none is known yet.
+func (c *Checker) checkHostIP(session *sshproxy.Session, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	ip, port, err := net.SplitHostPort(remote.String())
+	if err != nil || net.ParseIP(ip) == nil || net.ParseIP(ip).IsUnspecified() {
+		return nil // e.g. tunneled through a jump host
+	}
+	if host, _, _ := net.SplitHostPort(hostname); host == ip {
+		return nil
+	}
+	address := net.JoinHostPort(ip, port)
+	err = c.check(address, remote, key)
+	var keyErr *knownhosts.KeyError
+	if err == nil || !errors.As(err, &keyErr) {
+		return err
+	}
+	if len(keyErr.Want) == 0 {
+		if err := c.add(address, key); err != nil {
+			c.logf("failed to add the host key for %s to known_hosts: %v", address, err)
+		}
+		return nil
+	}
+	c.report(session, ipMismatchReport(hostname, address, key, keyErr.Want, c.Policy != Strict))
+	if c.Policy == Strict {
+		return err
+	}
+	return nil
+}
+
+// HostKeyAlgorithms orders the host key algorithms offered to a host, preferring the types of keys on file for it;
+// otherwise, the host might negotiate a type not on file, which would be treated as a changed key. It satisfies
+// sshproxy.TargetKeyAlgorithmsProvider.
+func (c *Checker) HostKeyAlgorithms(session *sshproxy.Session, address string) []string {
+	known := map[string]bool{}
+	if probe := c.probe(); probe != nil {
+		// the keys on file for a host are reported in the error for a key that can't match any of them
+		var keyErr *knownhosts.KeyError
+		err := c.check(c.lookupName(session, address), &net.TCPAddr{IP: net.IPv4zero, Port: 22}, probe)
+		if errors.As(err, &keyErr) {
+			for _, want := range keyErr.Want {
+				known[want.Key.Type()] = true
+			}
+		}
+	}
+	// OpenSSH's defaults rather than the SSH library's, which include SHA-1 (ssh-rsa) signatures and DSA keys
+	algorithms := c.Algorithms
+	if algorithms == nil {
+		algorithms = sshconfig.DefaultAlgorithms("HostKeyAlgorithms")
+	}
+	if len(known) == 0 {
+		return algorithms
+	}
+	var preferred, others []string
+	for _, algorithm := range algorithms {
+		if known[keyTypeOf(algorithm)] {
+			preferred = append(preferred, algorithm)
+		} else {
+			others = append(others, algorithm)
+		}
+	}
+	return append(preferred, others...)
+}
+
+// keyTypeOf is the type of (plain) key a host key algorithm uses; certificate algorithms have none.
+func keyTypeOf(algorithm string) string {
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512:
+		return ssh.KeyAlgoRSA
+	}
+	return algorithm
+}
+
+// probe is a throwaway key, which will never be on file for any host.
+func (c *Checker) probe() ssh.PublicKey {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.probeKey == nil {
+		if signer, err := sshproxy.GenHostKey(); err == nil {
+			c.probeKey = signer.PublicKey()
+		}
+	}
+	return c.probeKey
+}
+
+// check consults the known_hosts files as they are now, including any keys added since the proxy started.
+func (c *Checker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	var files []string
+	for _, file := range append(append([]string{}, c.KnownHostsFiles...), c.GlobalKnownHostsFiles...) {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return err
+	}
+	return callback(hostname, remote, key)
+}
+
+// confirm asks the downstream user whether to trust an unknown host key, as the OpenSSH client does.
+func (c *Checker) confirm(session *sshproxy.Session, hostname string, remote net.Addr, key ssh.PublicKey) bool {
+	fingerprint := ssh.FingerprintSHA256(key)
+	host := knownhosts.Normalize(hostname)
+	if remoteHost, _, err := net.SplitHostPort(remote.String()); err == nil && !strings.Contains(hostname, remoteHost) {
+		host = fmt.Sprintf("%s (%s)", host, remoteHost)
+	}
+	message := fmt.Sprintf("The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.\n%s",
+		host, keyTypeName(key), fingerprint, Randomart(key))
+
+	prompt := "Are you sure you want to continue connecting (yes/no/[fingerprint])? "
+	for attempt := 0; attempt < 3; attempt++ {
+		answer := make(chan string, 1)
+		err := session.Ask(&sshproxy.ProxiedAuthQuestion{
+			Message: message,
+			Prompt:  prompt,
+			Echo:    true,
+			OnAnswer: func(response string) bool {
+				answer <- strings.TrimSpace(response)
+				return true
+			},
+		})
+		if err != nil {
+			return false
+		}
+		switch response := <-answer; {
+		case strings.EqualFold(response, "yes"), response == fingerprint:
+			return true
+		case strings.EqualFold(response, "no"):
+			c.logf("host key %s %s for %s declined by %v", key.Type(), fingerprint, hostname, session.RemoteAddr())
+			return false
+		}
+		message = ""
+		prompt = "Please type 'yes', 'no' or the fingerprint: "
+	}
+	return false
+}
+
+// add appends the host key to the user's known_hosts file.
+func (c *Checker) add(hostname string, key ssh.PublicKey) error {
+	if len(c.KnownHostsFiles) == 0 {
+		return errors.New("no known_hosts file to add the host key to")
+	}
+	file := c.KnownHostsFiles[0]
+	address := knownhosts.Normalize(hostname)
+	if c.HashKnownHosts {
+		address = knownhosts.HashHostname(address)
+	}
+	line := knownhosts.Line([]string{address}, key) + "\n"
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	if existing, err := os.ReadFile(file); err == nil && len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		line = "\n" + line
+	}
+	knownHosts, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := knownHosts.WriteString(line); err != nil {
+		_ = knownHosts.Close()
+		return err
+	}
+	if err := knownHosts.Close(); err != nil {
+		return err
+	}
+	c.logf("permanently added %s host key %s for %s to %s", key.Type(), ssh.FingerprintSHA256(key), hostname, file)
+	return nil
+}
+
+func (c *Checker) logf(format string, args ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, args...)
+	}
+}
@@ -0,0 +1,529 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hostcheck
+
+import (
+	"nosshtradamus/internal/sshproxy"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"context"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Host keys are checked end to end: a downstream client connects through a proxy whose TargetKeyChecker is a Checker,
+// to a target presenting a known host key, and answers the questions relayed to it.
+
+// runTarget runs a target SSH server with the host key, accepting any client, and returns its port.
+func runTarget(t *testing.T, hostKey ssh.Signer) int {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					_ = nc.Reject(ssh.Prohibited, "no channels")
+				}
+				_ = serverConn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func newHostKey(t *testing.T) ssh.Signer {
+	hostKey, err := sshproxy.GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hostKey
+}
+
+// connectVia connects a downstream client to the target address through a proxy checking host keys with the checker.
+// The client answers every question relayed to it with the answer; everything it was shown is returned.
+func connectVia(t *testing.T, checker *Checker, address, answer string) (string, error) {
+	proxy, err := sshproxy.NewProxy(nil, &sshproxy.ProxyConfig{
+		KeyProvider:         sshproxy.EphemeralHostKey,
+		TargetResolver:      sshproxy.StaticHostTarget(address),
+		TargetKeyChecker:    checker.Callback,
+		TargetKeyAlgorithms: checker.HostKeyAlgorithms,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = proxy.Serve(context.Background(), listener) }()
+	defer func() { _ = proxy.Close() }()
+
+	var shown strings.Builder
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "tester",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth: []ssh.AuthMethod{ssh.KeyboardInteractive(
+			func(_, instruction string, questions []string, _ []bool) ([]string, error) {
+				shown.WriteString(instruction)
+				answers := make([]string, len(questions))
+				for idx, question := range questions {
+					shown.WriteString(question)
+					answers[idx] = answer
+				}
+				return answers, nil
+			})},
+		Timeout: 5 * time.Second,
+	})
+	if err == nil {
+		_ = client.Close()
+	}
+	return shown.String(), err
+}
+
+// newChecker makes a checker whose user known_hosts file (returned) initially holds the lines.
+func newChecker(t *testing.T, policy Policy, lines ...string) (*Checker, string) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if len(lines) > 0 {
+		if err := os.WriteFile(knownHosts, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Checker{KnownHostsFiles: []string{knownHosts}, Policy: policy}, knownHosts
+}
+
+func knownHostsLine(host string, port int, key ssh.PublicKey) string {
+	return knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(host, strconv.Itoa(port)))}, key)
+}
+
+// expectOnFile checks that the known_hosts file holds the key for each of the hosts.
+func expectOnFile(t *testing.T, knownHosts string, port int, key ssh.PublicKey, hosts ...string) {
+	t.Helper()
+	callback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	for _, host := range hosts {
+		if err := callback(net.JoinHostPort(host, strconv.Itoa(port)), remote, key); err != nil {
+			t.Errorf("expected the key on file for %s: %v", host, err)
+		}
+	}
+}
+
+func TestLookupByHostName(t *testing.T) {
+	hostKey := newHostKey(t)
+	port := runTarget(t, hostKey)
+
+	// the key is on file under the target's name only, as the OpenSSH client records it
+	checker, _ := newChecker(t, Strict, knownHostsLine("localhost", port, hostKey.PublicKey()))
+	if _, err := connectVia(t, checker, net.JoinHostPort("localhost", strconv.Itoa(port)), "no"); err != nil {
+		t.Fatalf("expected the key on file for the host name to be accepted: %v", err)
+	}
+
+	// and not found under another name for the same address
+	checker, _ = newChecker(t, Strict, knownHostsLine("localhost", port, hostKey.PublicKey()))
+	if _, err := connectVia(t, checker, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), "no"); err == nil {
+		t.Fatal("expected the key to be unknown under the IP address")
+	}
+}
+
+func TestCheckHostIPRecordsAddress(t *testing.T) {
+	hostKey := newHostKey(t)
+	port := runTarget(t, hostKey)
+
+	checker, knownHosts := newChecker(t, AcceptNew)
+	checker.CheckHostIP = true
+	if _, err := connectVia(t, checker, net.JoinHostPort("localhost", strconv.Itoa(port)), "no"); err != nil {
+		t.Fatal(err)
+	}
+	expectOnFile(t, knownHosts, port, hostKey.PublicKey(), "localhost", "127.0.0.1")
+}
+
+func TestCheckHostIPMismatch(t *testing.T) {
+	hostKey := newHostKey(t)
+	port := runTarget(t, hostKey)
+	lines := []string{
+		knownHostsLine("localhost", port, hostKey.PublicKey()),
+		knownHostsLine("127.0.0.1", port, newHostKey(t).PublicKey()),
+	}
+
+	checker, _ := newChecker(t, Strict, lines...)
+	checker.CheckHostIP = true
+	shown, err := connectVia(t, checker, net.JoinHostPort("localhost", strconv.Itoa(port)), "no")
+	if err == nil {
+		t.Fatal("expected strict checking to refuse a key differing from the one on file for the IP address")
+	}
+	if !strings.Contains(shown, "DNS SPOOFING") {
+		t.Errorf("expected the client to be warned of DNS spoofing, was shown %q", shown)
+	}
+
+	checker, _ = newChecker(t, AcceptNew, lines...)
+	checker.CheckHostIP = true
+	shown, err = connectVia(t, checker, net.JoinHostPort("localhost", strconv.Itoa(port)), "no")
+	if err != nil {
+		t.Fatalf("expected the key for the host name to be accepted despite the IP address mismatch: %v", err)
+	}
+	if !strings.Contains(shown, "DNS SPOOFING") {
+		t.Errorf("expected the client to be warned of DNS spoofing, was shown %q", shown)
+	}
+
+	// no IP address check for a target named by its address
+	checker, _ = newChecker(t, Strict, knownHostsLine("127.0.0.1", port, hostKey.PublicKey()))
+	checker.CheckHostIP = true
+	if _, err := connectVia(t, checker, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), "no"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// localhost is the target address of the port, by name.
+func localhost(port int) string {
+	return net.JoinHostPort("localhost", strconv.Itoa(port))
+}
+
+func readKnownHosts(t *testing.T, knownHosts string) string {
+	t.Helper()
+	contents, err := os.ReadFile(knownHosts)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestStrict(t *testing.T) {
+	hostKey := newHostKey(t)
+	port := runTarget(t, hostKey)
+
+	checker, knownHosts := newChecker(t, Strict)
+	shown, err := connectVia(t, checker, localhost(port), "yes")
+	if err == nil {
+		t.Fatal("expected strict checking to refuse an unknown host key")
+	}
+	if !strings.Contains(shown, "strict checking is enabled") || !strings.Contains(shown,
+		ssh.FingerprintSHA256(hostKey.PublicKey())) {
+		t.Errorf("expected the client to be told of the unknown key, was shown %q", shown)
+	}
+	if contents := readKnownHosts(t, knownHosts); contents != "" {
+		t.Errorf("expected nothing to be added to known_hosts, got %q", contents)
+	}
+
+	// a key on file in a global file is accepted; a changed one is not
+	global := filepath.Join(t.TempDir(), "ssh_known_hosts")
+	if err := os.WriteFile(global, []byte(knownHostsLine("localhost", port, hostKey.PublicKey())+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checker.GlobalKnownHostsFiles = []string{global}
+	if _, err := connectVia(t, checker, localhost(port), "no"); err != nil {
+		t.Errorf("expected the key on file to be accepted: %v", err)
+	}
+	checker, _ = newChecker(t, Strict, knownHostsLine("localhost", port, newHostKey(t).PublicKey()))
+	if shown, err := connectVia(t, checker, localhost(port), "yes"); err == nil {
+		t.Error("expected strict checking to refuse a changed host key")
+	} else if !strings.Contains(shown, "REMOTE HOST IDENTIFICATION HAS CHANGED") {
+		t.Errorf("expected the client to be warned of the changed key, was shown %q", shown)
+	}
+}
+
+func TestAcceptNew(t *testing.T) {
+	hostKey := newHostKey(t)
+	port := runTarget(t, hostKey)
+
+	checker, knownHosts := newChecker(t, AcceptNew)
+	if _, err := connectVia(t, checker, localhost(port), "no"); err != nil {
+		t.Fatalf("expected an unknown host key to be accepted: %v", err)
+	}
+	expectOnFile(t, knownHosts, port, hostKey.PublicKey(), "localhost")
+	// and accepted from then on, without being added again
+	if _, err := connectVia(t, checker, localhost(port), "no"); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(readKnownHosts(t, knownHosts), "\n"); lines != 1 {
+		t.Errorf("expected the key to be on file once, got %d lines", lines)
+	}
+
+	checker, knownHosts = newChecker(t, AcceptNew, knownHostsLine("localhost", port, newHostKey(t).PublicKey()))
+	if _, err := connectVia(t, checker, localhost(port), "yes"); err == nil {
+		t.Error("expected a changed host key to be refused")
+	}
+	if lines := strings.Count(readKnownHosts(t, knownHosts), "\n"); lines != 1 {
+		t.Errorf("expected the changed key not to be added, got %d lines", lines)
+	}
+}
+
+func TestAsk(t *testing.T) {
+	hostKey := newHostKey(t)
+	port := runTarget(t, hostKey)
+	fingerprint := ssh.FingerprintSHA256(hostKey.PublicKey())
+
+	checker, knownHosts := newChecker(t, Ask)
+	shown, err := connectVia(t, checker, localhost(port), "no")
+	if err == nil {
+		t.Fatal("expected a declined host key to be refused")
+	}
+	if !strings.Contains(shown, "The authenticity of host '[localhost]:"+strconv.Itoa(port)) ||
+		!strings.Contains(shown, fingerprint) || !strings.Contains(shown, Randomart(hostKey.PublicKey())) {
+		t.Errorf("expected the client to be asked about the key, was shown %q", shown)
+	}
+	if contents := readKnownHosts(t, knownHosts); contents != "" {
+		t.Errorf("expected a declined key not to be added, got %q", contents)
+	}
+
+	if shown, err := connectVia(t, checker, localhost(port), "maybe"); err == nil {
+		t.Error("expected a host key to be refused after three invalid answers")
+	} else if strings.Count(shown, "Please type 'yes', 'no' or the fingerprint") != 2 {
+		t.Errorf("expected the client to be asked again twice, was shown %q", shown)
+	}
+
+	for _, answer := range []string{"yes", "YES", fingerprint} {
+		checker, knownHosts := newChecker(t, Ask)
+		if _, err := connectVia(t, checker, localhost(port), answer); err != nil {
+			t.Errorf("expected the host key to be accepted with %q: %v", answer, err)
+		}
+		expectOnFile(t, knownHosts, port, hostKey.PublicKey(), "localhost")
+	}
+
+	// changed keys are refused without asking
+	checker, _ = newChecker(t, Ask, knownHostsLine("localhost", port, newHostKey(t).PublicKey()))
+	if shown, err := connectVia(t, checker, localhost(port), "yes"); err == nil {
+		t.Error("expected a changed host key to be refused")
+	} else if strings.Contains(shown, "authenticity") {
+		t.Errorf("expected no question about a changed key, was shown %q", shown)
+	}
+}
+
+func TestOff(t *testing.T) {
+	hostKey := newHostKey(t)
+	port := runTarget(t, hostKey)
+	oldKey := newHostKey(t).PublicKey()
+
+	checker, knownHosts := newChecker(t, Off, knownHostsLine("localhost", port, oldKey))
+	shown, err := connectVia(t, checker, localhost(port), "no")
+	if err != nil {
+		t.Fatalf("expected a changed host key to be accepted: %v", err)
+	}
+	if !strings.Contains(shown, "REMOTE HOST IDENTIFICATION HAS CHANGED") || !strings.Contains(shown,
+		"connecting anyway") {
+		t.Errorf("expected the client to be warned of the changed key, was shown %q", shown)
+	}
+	// the key on file is left as it is
+	if contents := readKnownHosts(t, knownHosts); contents != knownHostsLine("localhost", port, oldKey)+"\n" {
+		t.Errorf("expected known_hosts to be left unchanged, got %q", contents)
+	}
+
+	checker, knownHosts = newChecker(t, Off)
+	if _, err := connectVia(t, checker, localhost(port), "no"); err != nil {
+		t.Fatal(err)
+	}
+	expectOnFile(t, knownHosts, port, hostKey.PublicKey(), "localhost")
+}
+
+func TestHashKnownHosts(t *testing.T) {
+	hostKey := newHostKey(t)
+	port := runTarget(t, hostKey)
+
+	// an existing file without a trailing newline is appended to on a line of its own
+	checker, knownHosts := newChecker(t, AcceptNew)
+	other := knownHostsLine("other.example.com", 22, newHostKey(t).PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(other), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checker.HashKnownHosts = true
+	checker.CheckHostIP = true
+	if _, err := connectVia(t, checker, localhost(port), "no"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(readKnownHosts(t, knownHosts)), "\n")
+	if len(lines) != 3 || lines[0] != other {
+		t.Fatalf("expected two lines added to known_hosts, got %q", lines)
+	}
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, "|1|") || strings.Contains(line, "localhost") || strings.Contains(line,
+			"127.0.0.1") {
+			t.Errorf("expected a hashed host name, got %q", line)
+		}
+	}
+	expectOnFile(t, knownHosts, port, hostKey.PublicKey(), "localhost", "127.0.0.1")
+	// and the hashed entries are found again
+	checker.Policy = Strict
+	if _, err := connectVia(t, checker, localhost(port), "no"); err != nil {
+		t.Errorf("expected the hashed entry to be found: %v", err)
+	}
+}
+
+func TestRevoked(t *testing.T) {
+	hostKey := newHostKey(t)
+	port := runTarget(t, hostKey)
+
+	for _, policy := range []Policy{Strict, AcceptNew, Ask, Off} {
+		checker, knownHosts := newChecker(t, policy, "@revoked * "+strings.TrimSpace(string(
+			ssh.MarshalAuthorizedKey(hostKey.PublicKey()))), knownHostsLine("localhost", port, hostKey.PublicKey()))
+		shown, err := connectVia(t, checker, localhost(port), "yes")
+		if err == nil {
+			t.Errorf("policy %d: expected a revoked host key to be refused", policy)
+		}
+		if !strings.Contains(shown, "REVOKED HOST KEY DETECTED") {
+			t.Errorf("policy %d: expected the client to be told of the revoked key, was shown %q", policy, shown)
+		}
+		if lines := strings.Count(readKnownHosts(t, knownHosts), "\n"); lines != 2 {
+			t.Errorf("policy %d: expected nothing to be added to known_hosts, got %d lines", policy, lines)
+		}
+	}
+}
+
+// newHostCert certifies the host key for the principals with the authority.
+func newHostCert(t *testing.T, authority, hostKey ssh.Signer, principals ...string) ssh.Signer {
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		KeyId:           "test host",
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certSigner
+}
+
+func certAuthorityLine(pattern string, authority ssh.PublicKey) string {
+	return "@cert-authority " + pattern + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(authority)))
+}
+
+func TestCertAuthority(t *testing.T) {
+	authority, hostKey := newHostKey(t), newHostKey(t)
+	port := runTarget(t, newHostCert(t, authority, hostKey, "localhost"))
+
+	// a certificate signed by an authority trusted for the host is accepted, without adding anything (the SSH library
+	// only matches patterns without a port against port 22)
+	trusted := certAuthorityLine("[*]:"+strconv.Itoa(port), authority.PublicKey())
+	checker, knownHosts := newChecker(t, AcceptNew, trusted)
+	if _, err := connectVia(t, checker, localhost(port), "no"); err != nil {
+		t.Fatalf("expected a host certificate from a trusted authority to be accepted: %v", err)
+	}
+	if lines := strings.Count(readKnownHosts(t, knownHosts), "\n"); lines != 1 {
+		t.Errorf("expected nothing to be added to known_hosts, got %d lines", lines)
+	}
+
+	// an authority trusted for other hosts only isn't, so the plain key is checked instead
+	checker, _ = newChecker(t, Strict, certAuthorityLine("*.example.com", authority.PublicKey()))
+	if _, err := connectVia(t, checker, localhost(port), "no"); err == nil {
+		t.Error("expected a host certificate from an authority not trusted for the host to be refused")
+	}
+	checker, _ = newChecker(t, Strict, certAuthorityLine("*.example.com", authority.PublicKey()),
+		knownHostsLine("localhost", port, hostKey.PublicKey()))
+	if _, err := connectVia(t, checker, localhost(port), "no"); err != nil {
+		t.Errorf("expected the certified key on file to be accepted: %v", err)
+	}
+
+	// a revoked authority is refused, even though the key is on file
+	checker, _ = newChecker(t, Off, trusted,
+		"@revoked * "+strings.TrimSpace(string(ssh.MarshalAuthorizedKey(authority.PublicKey()))),
+		knownHostsLine("localhost", port, hostKey.PublicKey()))
+	if shown, err := connectVia(t, checker, localhost(port), "yes"); err == nil {
+		t.Error("expected a host certificate from a revoked authority to be refused")
+	} else if !strings.Contains(shown, "REVOKED HOST KEY DETECTED") {
+		t.Errorf("expected the client to be told of the revoked authority, was shown %q", shown)
+	}
+
+	// a certificate for another host name isn't accepted either
+	port = runTarget(t, newHostCert(t, authority, hostKey, "other.example.com"))
+	checker, _ = newChecker(t, Strict, certAuthorityLine("[*]:"+strconv.Itoa(port), authority.PublicKey()))
+	if _, err := connectVia(t, checker, localhost(port), "no"); err == nil {
+		t.Error("expected a host certificate for another host to be refused")
+	}
+}
+
+func TestRandomart(t *testing.T) {
+	// as shown by OpenSSH 9.2's ssh-keygen -lv for each key
+	for key, art := range map[string]string{
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIL/2rOXRw8ivgn85wSfCtoLWH9X+AlpGjBWg7MncASgv": "" +
+			"+--[ED25519 256]--+\n" +
+			"|         ..+o    |\n" +
+			"|        . o=..   |\n" +
+			"|       *  +oB    |\n" +
+			"|      o =o.X+o   |\n" +
+			"|       oSo@=o..  |\n" +
+			"|        +o=X.+   |\n" +
+			"|       ...E++ o  |\n" +
+			"|       o .oo.  . |\n" +
+			"|      . .+o      |\n" +
+			"+----[SHA256]-----+\n",
+		"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQDH11dCOLD8mYeTUd6xw6LDWI8rrzU3OkbvjBmzL8X30zpoIbtj0+ndoltDQxKis3tV" +
+			"NIhOxntEVAGCaUfv4UDl3+0QPUgY7P1Z+j5mt79RFtkB/zDWRQfJ1dyBJCpG1Ud3UsGsyWnjIOFspcg/ZSuEo6GcxG5aixj9bhy+7FlEbfb" +
+			"KPjAJi4LHVraM3Qj6urttS+oHLmUFKIGUoxBe++kVptNrNB0l55ddjFRsZAum8Hsp+WyqG8u0mhGh1/8EQGXM833fYDR/Bm/f7uZi4BXCPs" +
+			"2SY5DDnVorL9FlyISUn9Ty/tGLr9Uiy4hljWKa7YhAVzOhzzTnAjeRp2qZck+v": "" +
+			"+---[RSA 2048]----+\n" +
+			"|                 |\n" +
+			"|       . . .     |\n" +
+			"|       .= = .    |\n" +
+			"|     . =EB....   |\n" +
+			"|      + Soo+..   |\n" +
+			"|       =++o.* .  |\n" +
+			"|      o.o+ o B . |\n" +
+			"|     ..oo.o.+.B .|\n" +
+			"|     .+o.+++. .* |\n" +
+			"+----[SHA256]-----+\n",
+		"ecdsa-sha2-nistp384 AAAAE2VjZHNhLXNoYTItbmlzdHAzODQAAAAIbmlzdHAzODQAAABhBF7Hw+R0TMHsAvJWus9wRKxsV50xqKfk" +
+			"Gl71FKtcasP78YS5Ighamd+0ImZZLhQH+lT2+AJsNFpHhIEhTGQsnKwH1aLZNY+647K8lHsNhm8ZPMbrwSbsESHIspC8PH4mEw==": "" +
+			"+---[ECDSA 384]---+\n" +
+			"|       +oo+      |\n" +
+			"|      o o=..     |\n" +
+			"|     . ....      |\n" +
+			"|      . .       +|\n" +
+			"|     . oS  .  .o=|\n" +
+			"|      . o..o..E*=|\n" +
+			"|       o oo.+.o+O|\n" +
+			"|      . =.+oo. =+|\n" +
+			"|      .o.=+*o..oo|\n" +
+			"+----[SHA256]-----+\n",
+	} {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rendered := Randomart(publicKey); rendered != art {
+			t.Errorf("expected the randomart of %s to be\n%s, got\n%s", publicKey.Type(), art, rendered)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package hostcheck
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// Randomart renders the "drunken bishop" visualization of a key's SHA256 fingerprint, identical to the one shown by
+// OpenSSH (VisualHostKey), so it can be compared at a glance.
+func Randomart(key ssh.PublicKey) string {
+	const (
+		width   = 17
+		height  = 9
+		symbols = " .o+=*BOX@%&#/^SE"
+		start   = len(symbols) - 2
+		end     = len(symbols) - 1
+	)
+	var field [width][height]int
+
+	digest := sha256.Sum256(key.Marshal())
+	x, y := width/2, height/2
+	for _, input := range digest {
+		// each byte moves the bishop four times, two bits at a time
+		for step := 0; step < 4; step++ {
+			if input&0x1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if input&0x2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = clamp(x, 0, width-1)
+			y = clamp(y, 0, height-1)
+			if field[x][y] < start-1 {
+				field[x][y]++
+			}
+			input >>= 2
+		}
+	}
+	field[width/2][height/2] = start
+	field[x][y] = end
+
+	var art strings.Builder
+	art.WriteString(frame(fmt.Sprintf("[%s %d]", keyTypeName(key), keyBits(key)), width))
+	for row := 0; row < height; row++ {
+		art.WriteString("|")
+		for col := 0; col < width; col++ {
+			art.WriteByte(symbols[field[col][row]])
+		}
+		art.WriteString("|\n")
+	}
+	art.WriteString(frame("[SHA256]", width))
+	return art.String()
+}
+
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// frame renders a border line of the randomart box, with a centered title.
+func frame(title string, width int) string {
+	if len(title) > width {
+		title = title[:width]
+	}
+	padding := (width - len(title)) / 2
+	return "+" + strings.Repeat("-", padding) + title + strings.Repeat("-", width-padding-len(title)) + "+\n"
+}
+
+func keyTypeName(key ssh.PublicKey) string {
+	switch key.Type() {
+	case ssh.KeyAlgoED25519:
+		return "ED25519"
+	case ssh.KeyAlgoRSA:
+		return "RSA"
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return "ECDSA"
+	case ssh.KeyAlgoSKED25519:
+		return "ED25519-SK"
+	case ssh.KeyAlgoSKECDSA256:
+		return "ECDSA-SK"
+	case ssh.KeyAlgoDSA:
+		return "DSA"
+	}
+	return strings.ToUpper(key.Type())
+}
+
+func keyBits(key ssh.PublicKey) int {
+	if cryptoKey, ok := key.(ssh.CryptoPublicKey); ok {
+		switch pub := cryptoKey.CryptoPublicKey().(type) {
+		case *rsa.PublicKey:
+			return pub.N.BitLen()
+		case *ecdsa.PublicKey:
+			return pub.Curve.Params().BitSize
+		case ed25519.PublicKey:
+			return 256
+		}
+	}
+	switch key.Type() {
+	case ssh.KeyAlgoSKED25519, ssh.KeyAlgoSKECDSA256:
+		return 256
+	}
+	return 0
+}
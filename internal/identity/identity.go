@@ -0,0 +1,241 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package identity loads the private keys (and certificates) the proxy authenticates to targets with, from identity
+// files in the OpenSSH, PKCS#8 and legacy PEM formats. Passphrase protected keys are loaded without decrypting them,
+// so that their passphrases can be asked for once they are needed.
+package identity
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// An Identity is a private key read from an identity file. The private key of an encrypted identity is only available
+// once it is decrypted with its passphrase.
+type Identity struct {
+	Path      string
+	PublicKey ssh.PublicKey
+	Signer    ssh.Signer // nil for encrypted identities
+
+	keyBytes []byte // the identity file, if encrypted
+}
+
+// Encrypted reports whether the identity's private key is passphrase protected.
+func (id *Identity) Encrypted() bool {
+	return id.Signer == nil
+}
+
+// DecryptKey decrypts the private key of an encrypted identity with its passphrase, returning the key itself (e.g. an
+// *rsa.PrivateKey), so that it can later be erased with Zero.
+func (id *Identity) DecryptKey(passphrase []byte) (interface{}, error) {
+	if id.Signer != nil {
+		return nil, errors.New("not an encrypted identity")
+	}
+	return ssh.ParseRawPrivateKeyWithPassphrase(id.keyBytes, passphrase)
+}
+
+// Zero overwrites the secret parts of a private key returned by DecryptKey. This is a best effort: copies made by the
+// standard library (e.g. precomputed RSA values) are beyond reach.
+func Zero(key interface{}) {
+	zeroInt := func(x *big.Int) {
+		if x == nil {
+			return
+		}
+		words := x.Bits()
+		for idx := range words {
+			words[idx] = 0
+		}
+		x.SetInt64(0)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		zeroInt(key.D)
+		for _, prime := range key.Primes {
+			zeroInt(prime)
+		}
+		zeroInt(key.Precomputed.Dp)
+		zeroInt(key.Precomputed.Dq)
+		zeroInt(key.Precomputed.Qinv)
+	case *ecdsa.PrivateKey:
+		zeroInt(key.D)
+	case *dsa.PrivateKey:
+		zeroInt(key.X)
+	case ed25519.PrivateKey:
+		for idx := range key {
+			key[idx] = 0
+		}
+	case *ed25519.PrivateKey:
+		Zero(*key)
+	}
+}
+
+// Load reads the identity file at the path. The public key of an encrypted identity is taken from the file itself if
+// it is in the OpenSSH format, or otherwise from the "<path>.pub" file beside it.
+func Load(path string) (*Identity, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err == nil {
+		return &Identity{Path: path, PublicKey: signer.PublicKey(), Signer: signer}, nil
+	}
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		if block, _ := pem.Decode(keyBytes); block != nil && block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, errors.New("encrypted PKCS#8 keys are not supported (convert with ssh-keygen -p)")
+		}
+		return nil, err
+	}
+	publicKey := missing.PublicKey
+	if publicKey == nil {
+		publicKey = openSSHPublicKey(keyBytes)
+	}
+	if publicKey == nil {
+		pubBytes, err := os.ReadFile(path + ".pub")
+		if err != nil {
+			return nil, fmt.Errorf("passphrase protected, and its public key is unavailable: %w", err)
+		}
+		if publicKey, _, _, _, err = ssh.ParseAuthorizedKey(pubBytes); err != nil {
+			return nil, fmt.Errorf("%s.pub: %w", path, err)
+		}
+	}
+	return &Identity{Path: path, PublicKey: publicKey, keyBytes: keyBytes}, nil
+}
+
+// LoadAll reads each of the identity files in turn, omitting any whose key was already read. Problems with individual
+// files are returned alongside the identities that could be read.
+func LoadAll(paths []string) ([]*Identity, []error) {
+	var identities []*Identity
+	var problems []error
+	loaded := map[string]bool{}
+	for _, path := range paths {
+		identity, err := Load(path)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("identity %s: %w", path, err))
+			continue
+		}
+		if keyID := KeyID(identity.PublicKey); !loaded[keyID] {
+			loaded[keyID] = true
+			identities = append(identities, identity)
+		}
+	}
+	return identities, problems
+}
+
+// openSSHKeyHeader is the unencrypted start of a private key in the OpenSSH format (PROTOCOL.key in OpenSSH).
+type openSSHKeyHeader struct {
+	CipherName   string
+	KdfName      string
+	KdfOpts      string
+	NumKeys      uint32
+	PubKey       []byte
+	PrivKeyBlock []byte `ssh:"rest"`
+}
+
+const openSSHKeyMagic = "openssh-key-v1\x00"
+
+// openSSHPublicKey reads the public key stored unencrypted in an OpenSSH format private key, or returns nil.
+func openSSHPublicKey(keyBytes []byte) ssh.PublicKey {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" || !bytes.HasPrefix(block.Bytes, []byte(openSSHKeyMagic)) {
+		return nil
+	}
+	var header openSSHKeyHeader
+	if err := ssh.Unmarshal(block.Bytes[len(openSSHKeyMagic):], &header); err != nil || header.NumKeys != 1 {
+		return nil
+	}
+	publicKey, err := ssh.ParsePublicKey(header.PubKey)
+	if err != nil {
+		return nil
+	}
+	return publicKey
+}
+
+// KeyID identifies a public key (or certificate) by its wire encoding.
+func KeyID(key ssh.PublicKey) string {
+	return fmt.Sprintf("%x", key.Marshal())
+}
+
+// CertifiedKey is the key a certificate certifies, or the key itself if it is not a certificate.
+func CertifiedKey(key ssh.PublicKey) ssh.PublicKey {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return cert.Key
+	}
+	return key
+}
+
+// Only keeps the signers (e.g. from an agent) whose keys are those of the identities, as the IdentitiesOnly option
+// does; certificates count as the keys they certify.
+func Only(signers []ssh.Signer, identities []*Identity) []ssh.Signer {
+	keys := map[string]bool{}
+	for _, identity := range identities {
+		keys[KeyID(identity.PublicKey)] = true
+	}
+	var kept []ssh.Signer
+	for _, signer := range signers {
+		if keys[KeyID(CertifiedKey(signer.PublicKey()))] {
+			kept = append(kept, signer)
+		}
+	}
+	return kept
+}
+
+// LoadCertificate reads a user certificate, in authorized_keys format (as written by ssh-keygen).
+func LoadCertificate(path string) (*ssh.Certificate, error) {
+	certBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, errors.New("not a user certificate")
+	}
+	return cert, nil
+}
+
+// CertificatesFirst reorders signers to put those presenting certificates first, otherwise preserving their order.
+func CertificatesFirst(signers []ssh.Signer) []ssh.Signer {
+	ordered := make([]ssh.Signer, 0, len(signers))
+	for _, signer := range signers {
+		if _, isCert := signer.PublicKey().(*ssh.Certificate); isCert {
+			ordered = append(ordered, signer)
+		}
+	}
+	for _, signer := range signers {
+		if _, isCert := signer.PublicKey().(*ssh.Certificate); !isCert {
+			ordered = append(ordered, signer)
+		}
+	}
+	return ordered
+}
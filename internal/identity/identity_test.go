@@ -0,0 +1,260 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package identity
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPassphrase = "correct horse"
+
+// writeKey writes the PEM block as an identity file in the directory, and its public key beside it if given.
+func writeKey(t *testing.T, dir, name string, block *pem.Block, publicKey ssh.PublicKey) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if publicKey != nil {
+		if err := os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(publicKey), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func sshPublicKey(t *testing.T, key interface{}) ssh.PublicKey {
+	publicKey, err := ssh.NewPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openSSH, err := ssh.MarshalPrivateKey(edPrivate, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedOpenSSH, err := ssh.MarshalPrivateKeyWithPassphrase(edPrivate, "", []byte(testPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPEM, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	// legacy encrypted PEM, as older versions of ssh-keygen wrote
+	encryptedPEM, err := x509.EncryptPEMBlock(rand.Reader, rsaPEM.Type, rsaPEM.Bytes, []byte(testPassphrase),
+		x509.PEMCipherAES128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		block     *pem.Block
+		pub       ssh.PublicKey // written as the .pub file, if set
+		publicKey ssh.PublicKey
+		encrypted bool
+		err       string // expected in the error, if loading fails
+	}{
+		{"openssh", openSSH, nil, sshPublicKey(t, edPublic), false, ""},
+		{"pkcs8", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}, nil, sshPublicKey(t, &ecKey.PublicKey), false, ""},
+		{"legacy rsa", rsaPEM, nil, sshPublicKey(t, &rsaKey.PublicKey), false, ""},
+		{"legacy ec", &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecPEM}, nil, sshPublicKey(t, &ecKey.PublicKey), false,
+			""},
+		// the public key of an encrypted OpenSSH key is stored unencrypted in the file itself
+		{"encrypted openssh", encryptedOpenSSH, nil, sshPublicKey(t, edPublic), true, ""},
+		{"encrypted legacy", encryptedPEM, sshPublicKey(t, &rsaKey.PublicKey), sshPublicKey(t, &rsaKey.PublicKey),
+			true, ""},
+		{"encrypted legacy without pub", encryptedPEM, nil, nil, true, "public key is unavailable"},
+		{"encrypted pkcs8", &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte("opaque")}, nil, nil, true,
+			"encrypted PKCS#8 keys are not supported"},
+	} {
+		path := writeKey(t, dir, strings.ReplaceAll(test.name, " ", "_"), test.block, test.pub)
+		id, err := Load(path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error about %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if id.Path != path || !bytes.Equal(id.PublicKey.Marshal(), test.publicKey.Marshal()) {
+			t.Errorf("%s: expected the identity's public key, got %s", test.name, ssh.FingerprintSHA256(id.PublicKey))
+		}
+		if id.Encrypted() != test.encrypted {
+			t.Errorf("%s: expected encrypted %v", test.name, test.encrypted)
+		}
+		if !test.encrypted {
+			if _, err := id.DecryptKey([]byte(testPassphrase)); err == nil {
+				t.Errorf("%s: expected an unencrypted identity not to be decrypted", test.name)
+			}
+			continue
+		}
+
+		// encrypted keys are only decrypted with the right passphrase
+		if _, err := id.DecryptKey([]byte("wrong")); !errors.Is(err, x509.IncorrectPasswordError) {
+			t.Errorf("%s: expected a wrong passphrase to be reported as such, got %v", test.name, err)
+		}
+		key, err := id.DecryptKey([]byte(testPassphrase))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if signer, err := ssh.NewSignerFromKey(key); err != nil ||
+			!bytes.Equal(signer.PublicKey().Marshal(), test.publicKey.Marshal()) {
+			t.Errorf("%s: expected the decrypted key to match its public key (%v)", test.name, err)
+		}
+	}
+
+	if _, err := Load(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing file to be reported, got %v", err)
+	}
+	if _, err := Load(writeKey(t, dir, "garbage", &pem.Block{Type: "GARBAGE", Bytes: []byte("x")}, nil)); err == nil {
+		t.Error("expected an unreadable key to be refused")
+	}
+}
+
+func TestLoadAll(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"id_first", "id_second"} {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, writeKey(t, dir, name, block, nil))
+	}
+	// the same key under another name, and files that cannot be read
+	duplicate := filepath.Join(dir, "id_duplicate")
+	keyBytes, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(duplicate, keyBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "id_missing")
+	garbage := writeKey(t, dir, "id_garbage", &pem.Block{Type: "GARBAGE", Bytes: []byte("x")}, nil)
+
+	identities, problems := LoadAll([]string{paths[0], missing, duplicate, paths[1], garbage})
+	if len(identities) != 2 || identities[0].Path != paths[0] || identities[1].Path != paths[1] {
+		t.Errorf("expected the two distinct identities in order, got %d", len(identities))
+	}
+	if len(problems) != 2 || !strings.Contains(problems[0].Error(), missing) ||
+		!strings.Contains(problems[1].Error(), garbage) {
+		t.Errorf("expected a problem for each unreadable file, naming it, got %v", problems)
+	}
+}
+
+// signers makes a signer for each of a number of new keys, and one presenting a certificate for the first.
+func signers(t *testing.T, count int) ([]ssh.Signer, ssh.Signer) {
+	var keys []ssh.Signer
+	for idx := 0; idx < count; idx++ {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, signer)
+	}
+	cert := &ssh.Certificate{
+		Key:             keys[0].PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"tester"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, keys[count-1]); err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys, certSigner
+}
+
+func TestCertificatesFirst(t *testing.T) {
+	keys, certSigner := signers(t, 3)
+	ordered := CertificatesFirst([]ssh.Signer{keys[0], keys[1], certSigner, keys[2]})
+	expected := []ssh.Signer{certSigner, keys[0], keys[1], keys[2]}
+	if len(ordered) != len(expected) {
+		t.Fatalf("expected %d signers, got %d", len(expected), len(ordered))
+	}
+	for idx := range expected {
+		if ordered[idx] != expected[idx] {
+			t.Errorf("expected the certificate first, then the keys in their order; signer %d differs", idx)
+		}
+	}
+}
+
+func TestOnly(t *testing.T) {
+	keys, certSigner := signers(t, 3)
+	identities := []*Identity{{Path: "id_first", PublicKey: keys[0].PublicKey()}}
+	kept := Only([]ssh.Signer{keys[1], certSigner, keys[0], keys[2]}, identities)
+	if len(kept) != 2 || kept[0] != certSigner || kept[1] != keys[0] {
+		t.Errorf("expected only the identity's key and its certificate to be kept, got %d signers", len(kept))
+	}
+	if kept := Only(keys, nil); len(kept) != 0 {
+		t.Errorf("expected no signers to be kept without identities, got %d", len(kept))
+	}
+}
@@ -60,6 +60,15 @@ func (ios *IoSwitch) Close() error {
 	}
 }
 
+// RenderMessage renders a message through the enabled alternative implementation if it is able to, or as plain text.
+func (ios *IoSwitch) RenderMessage(message string) []byte {
+	if renderer, ok := ios.refractor.(interface{ RenderMessage(string) []byte }); ios.enabled && ok {
+		return renderer.RenderMessage(message)
+	} else {
+		return []byte("\r\n" + message + "\r\n")
+	}
+}
+
 func (ios *IoSwitch) Enable(refractor io.ReadWriteCloser) {
 	if !ios.enabled {
 		ios.refractor = refractor
@@ -543,6 +543,17 @@ func (i *Interposer) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// RenderMessage produces output restoring the downstream terminal (as when the interposer is closed), followed by the
+// message on its own line. Used for notices displayed while the interposed session is being torn down.
+func (i *Interposer) RenderMessage(message string) []byte {
+	rendered := &bytes.Buffer{}
+	if i.opened {
+		rendered.WriteString(i.display.Close())
+	}
+	rendered.WriteString("\r\n" + message + "\r\n")
+	return rendered.Bytes()
+}
+
 // Resize the width and height of the interposed terminal, in response to e.g. SIGWINCH or equivalent signal.
 func (i *Interposer) Resize(w, h int) {
 	i.emulatorMutex.Lock()
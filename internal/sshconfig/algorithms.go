@@ -0,0 +1,137 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshconfig
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"fmt"
+	"strings"
+)
+
+// algorithmList is the default preference order of an algorithm option, and every algorithm it may name (including
+// legacy algorithms only used when explicitly enabled).
+type algorithmList struct {
+	defaults  []string
+	supported []string
+}
+
+// algorithmLists are the algorithms implemented by the SSH library, in OpenSSH's order of preference.
+var algorithmLists = map[string]algorithmList{
+	"ciphers": {
+		defaults: []string{
+			"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com",
+			"aes256-gcm@openssh.com",
+		},
+		supported: []string{"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour"},
+	},
+	"kexalgorithms": {
+		defaults: []string{
+			"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384",
+			"ecdh-sha2-nistp521", "diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512",
+			"diffie-hellman-group14-sha256",
+		},
+		supported: []string{
+			"diffie-hellman-group14-sha1", "diffie-hellman-group-exchange-sha1", "diffie-hellman-group1-sha1",
+		},
+	},
+	"macs": {
+		defaults: []string{
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512",
+			"hmac-sha1",
+		},
+		supported: []string{"hmac-sha1-96"},
+	},
+	"hostkeyalgorithms": {
+		defaults: []string{
+			ssh.CertAlgoED25519v01, ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+			ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+			ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+		},
+		// SHA-1 signatures (ssh-rsa) and DSA keys must be enabled explicitly, e.g. with "+ssh-rsa"
+		supported: []string{ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01},
+	},
+}
+
+// DefaultAlgorithms returns the default preference order for an algorithm option (Ciphers, KexAlgorithms, MACs or
+// HostKeyAlgorithms).
+func DefaultAlgorithms(keyword string) []string {
+	return append([]string{}, algorithmLists[key(keyword)].defaults...)
+}
+
+// Algorithms interprets an algorithm option (Ciphers, KexAlgorithms, MACs or HostKeyAlgorithms), or returns nil if
+// it is unset. As with OpenSSH, a list starting with "+" is appended to the defaults, one starting with "^" is placed
+// before them, and one starting with "-" is removed from them (and may use wildcards).
+func (s *Settings) Algorithms(keyword string) ([]string, error) {
+	if !s.IsSet(keyword) {
+		return nil, nil
+	}
+	return ParseAlgorithms(keyword, s.Get(keyword))
+}
+
+// ParseAlgorithms interprets the value of an algorithm option, as Settings.Algorithms does.
+func ParseAlgorithms(keyword, spec string) ([]string, error) {
+	list, ok := algorithmLists[key(keyword)]
+	if !ok {
+		return nil, fmt.Errorf("%s is not an algorithm option", keyword)
+	}
+	modifier := ""
+	if spec != "" && strings.ContainsAny(spec[:1], "+-^") {
+		modifier, spec = spec[:1], spec[1:]
+	}
+	var named []string
+	for _, algorithm := range strings.Split(spec, ",") {
+		algorithm = strings.TrimSpace(algorithm)
+		if modifier == "-" {
+			named = append(named, algorithm) // patterns, only matched against the defaults
+		} else if contains(list.defaults, algorithm) || contains(list.supported, algorithm) {
+			named = append(named, algorithm)
+		} else {
+			return nil, fmt.Errorf("unsupported %s algorithm %q", keyword, algorithm)
+		}
+	}
+
+	var algorithms []string
+	switch modifier {
+	case "":
+		return named, nil
+	case "^":
+		algorithms = append(algorithms, named...)
+		for _, algorithm := range list.defaults {
+			if !contains(named, algorithm) {
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	case "+":
+		algorithms = append(algorithms, list.defaults...)
+		for _, algorithm := range named {
+			if !contains(algorithms, algorithm) {
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	case "-":
+		for _, algorithm := range list.defaults {
+			if !matchPatterns(named, algorithm) {
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	return algorithms, nil
+}
@@ -0,0 +1,268 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package sshconfig reads OpenSSH client configuration (ssh_config) files, and resolves the settings they specify for
+// a host the same way the OpenSSH client does.
+package sshconfig
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const maxIncludeDepth = 16
+
+// A Config is the sequence of directives read from ssh_config files, in order of precedence.
+type Config struct {
+	directives []*directive
+}
+
+type directive struct {
+	keyword  string // lowercase
+	args     []string
+	filename string
+	line     int
+	included []*Config // for Include directives, the configuration read from each matching file
+}
+
+func (d *directive) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s line %d: %s", d.filename, d.line, fmt.Sprintf(format, args...))
+}
+
+// Load reads configuration files in order of precedence (e.g. the user's ~/.ssh/config before the system-wide
+// /etc/ssh/ssh_config); files that do not exist are skipped. Relative Include paths are resolved against the
+// directory of the file containing them.
+func Load(filenames ...string) (*Config, error) {
+	config := &Config{}
+	for _, filename := range filenames {
+		loaded, err := loadFile(filename, filepath.Dir(filename), 0)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		config.directives = append(config.directives, loaded.directives...)
+	}
+	return config, nil
+}
+
+func loadFile(filename, includeDir string, depth int) (*Config, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parse(file, filename, includeDir, depth)
+}
+
+func parse(r io.Reader, filename, includeDir string, depth int) (*Config, error) {
+	config := &Config{}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		keyword, args, err := splitLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", filename, lineNumber, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		d := &directive{
+			keyword:  strings.ToLower(keyword),
+			args:     args,
+			filename: filename,
+			line:     lineNumber,
+		}
+		if alias, ok := aliases[d.keyword]; ok {
+			d.keyword = strings.ToLower(alias)
+		}
+		switch d.keyword {
+		case "host", "match", "include":
+			if len(args) == 0 {
+				return nil, d.errorf("%s directive without arguments", keyword)
+			}
+		}
+		if d.keyword == "include" {
+			if depth >= maxIncludeDepth {
+				return nil, d.errorf("too many nested includes")
+			}
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(includeDir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return nil, d.errorf("invalid include pattern %q", pattern)
+				}
+				for _, match := range matches {
+					included, err := loadFile(match, includeDir, depth+1)
+					if err != nil {
+						return nil, err
+					}
+					d.included = append(d.included, included)
+				}
+			}
+		}
+		config.directives = append(config.directives, d)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// splitLine splits a configuration line into its keyword and arguments. The keyword may be separated from the
+// arguments by whitespace and/or a single "="; arguments may be double quoted, and an unquoted "#" begins a comment.
+func splitLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return line, nil, nil
+	}
+	keyword, rest := line[:end], strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+	args, err := splitArgs(rest)
+	return keyword, args, err
+}
+
+// ParseOption splits a single option, as given on the command line ("Keyword=value" or "Keyword value"), into its
+// keyword and arguments.
+func ParseOption(option string) (string, []string, error) {
+	keyword, args, err := splitLine(option)
+	if err == nil && keyword == "" {
+		err = errors.New("empty option")
+	}
+	return keyword, args, err
+}
+
+// splitArgs splits whitespace separated arguments, which may be double quoted.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	for idx := 0; idx < len(s); idx++ {
+		c := s[idx]
+		switch {
+		case quoted && c == '"':
+			quoted = false
+		case quoted:
+			arg.WriteByte(c)
+		case c == '"':
+			quoted, inArg = true, true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case c == '#' && !inArg:
+			return args, nil
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Apply resolves the configuration for the settings' host: the arguments of each directive that applies to it are
+// set, unless already set (e.g. by an earlier directive, or from the command line), as the OpenSSH client does.
+// Unlike for the OpenSSH client, unknown keywords (e.g. those of other OpenSSH versions, such as macOS's UseKeychain)
+// are not an error: they are skipped, with a warning (see Settings.Warnings) unless matched by an IgnoreUnknown
+// pattern.
+func (c *Config) Apply(settings *Settings) error {
+	settings.final = false
+	settings.sawFinal = false
+	if err := c.apply(settings, true); err != nil {
+		return err
+	}
+	// as no host name canonicalization is done, a second pass is only needed for "Match final" blocks
+	if settings.sawFinal {
+		settings.final = true
+		return c.apply(settings, true)
+	}
+	return nil
+}
+
+func (c *Config) apply(settings *Settings, active bool) error {
+	for _, d := range c.directives {
+		switch d.keyword {
+		case "host":
+			active = matchHost(d.args, settings.host)
+			continue
+		case "match":
+			matched, err := settings.matchCriteria(d)
+			if err != nil {
+				return err
+			}
+			active = matched
+			continue
+		case "include":
+			if active {
+				for _, included := range d.included {
+					if err := included.apply(settings, true); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		keyword, known := keywords[d.keyword]
+		if !known {
+			// directives are only warned about once, not again when applied for "Match final" blocks
+			if !settings.final && !matchPatternList(settings.Get("IgnoreUnknown"), d.keyword, true) {
+				settings.warnings = append(settings.warnings, d.errorf("unsupported option %q ignored", d.keyword))
+			}
+			continue
+		}
+		if active {
+			settings.Set(keyword, d.args...)
+		}
+	}
+	return nil
+}
+
+func homeDir() string {
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return homeDir() + path[1:]
+	}
+	return path
+}
@@ -0,0 +1,379 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshconfig
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a configuration file of the lines into the directory, returning its path.
+func writeConfig(t *testing.T, dir, name string, lines ...string) string {
+	t.Helper()
+	filename := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// resolve applies the configuration file of the lines to the host, after any options already set (e.g. from the
+// command line), failing the test on any error.
+func resolve(t *testing.T, host string, options []string, lines ...string) *Settings {
+	t.Helper()
+	settings, err := tryResolve(t, host, options, lines...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return settings
+}
+
+func tryResolve(t *testing.T, host string, options []string, lines ...string) (*Settings, error) {
+	t.Helper()
+	settings := NewSettings(host)
+	for _, option := range options {
+		keyword, args, err := ParseOption(option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings.Set(keyword, args...)
+	}
+	config, err := Load(writeConfig(t, t.TempDir(), "config", lines...))
+	if err != nil {
+		return nil, err
+	}
+	return settings, config.Apply(settings)
+}
+
+func expectValue(t *testing.T, settings *Settings, keyword, expected string) {
+	t.Helper()
+	if value := settings.Get(keyword); value != expected {
+		t.Errorf("expected %s %q, got %q", keyword, expected, value)
+	}
+}
+
+func TestFirstValueWins(t *testing.T) {
+	lines := []string{
+		"Host db",
+		"  HostName db.example.com",
+		"  Port 2200",
+		"  IdentityFile ~/.ssh/id_db",
+		"Host *",
+		"  Port 22",
+		"  User fallback",
+		"  IdentityFile ~/.ssh/id_ed25519",
+		"  IdentityFile ~/.ssh/id_db",
+	}
+	settings := resolve(t, "db", nil, lines...)
+	expectValue(t, settings, "HostName", "db.example.com")
+	expectValue(t, settings, "Port", "2200")
+	expectValue(t, settings, "User", "fallback")
+	// cumulative, without duplicates
+	if files := settings.Values("IdentityFile"); !reflect.DeepEqual(files,
+		[]string{"~/.ssh/id_db", "~/.ssh/id_ed25519"}) {
+		t.Errorf("expected identity files from every matching block, got %v", files)
+	}
+
+	// options from the command line take precedence
+	settings = resolve(t, "db", []string{"Port=2222", "IdentityFile ~/.ssh/id_cli"}, lines...)
+	expectValue(t, settings, "Port", "2222")
+	if files := settings.Values("IdentityFile"); len(files) != 3 || files[0] != "~/.ssh/id_cli" {
+		t.Errorf("expected the command line identity file first, got %v", files)
+	}
+}
+
+func TestHostPatterns(t *testing.T) {
+	lines := []string{
+		"Host *.example.com !bastion.example.com",
+		"  User inner",
+		"Host bastion.* db?",
+		"  User edge",
+	}
+	for host, user := range map[string]string{
+		"web.example.com":     "inner",
+		"WEB.Example.COM":     "inner",
+		"bastion.example.com": "edge",
+		"db1":                 "edge",
+		"db10":                "",
+		"example.com":         "",
+	} {
+		expectValue(t, resolve(t, host, nil, lines...), "User", user)
+	}
+
+	// a block of only negated patterns matches nothing
+	expectValue(t, resolve(t, "web", nil, "Host !db", "  User nobody"), "User", "")
+}
+
+func TestLineSyntax(t *testing.T) {
+	settings := resolve(t, "host", nil,
+		"# a comment",
+		"",
+		"Port=2200",
+		`User = "the user"`,
+		"\tHostName\thost.example.com # trailing comment",
+		"FORWARDAGENT yes",
+		"PubkeyAcceptedKeyTypes ssh-ed25519",
+	)
+	expectValue(t, settings, "Port", "2200")
+	expectValue(t, settings, "User", "the user")
+	expectValue(t, settings, "HostName", "host.example.com")
+	expectValue(t, settings, "ForwardAgent", "yes")
+	expectValue(t, settings, "PubkeyAcceptedAlgorithms", "ssh-ed25519")
+
+	if _, err := tryResolve(t, "host", nil, `User "unterminated`); err == nil {
+		t.Error("expected an unterminated quote to be an error")
+	}
+	if _, err := tryResolve(t, "host", nil, "Host"); err == nil {
+		t.Error("expected Host without patterns to be an error")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	lines := []string{
+		"Host alias",
+		"  HostName real.example.com",
+		"Match originalhost alias user admin",
+		"  Port 2201",
+		"Match host real.example.com !user admin",
+		"  Port 2202",
+		"Match exec \"test %h = real.example.com\"",
+		"  User execuser",
+		"Match exec false",
+		"  Compression yes",
+		"Match final host real.example.com",
+		"  ConnectTimeout 5",
+		"Match all",
+		"  Port 22",
+		"  Compression no",
+	}
+	settings := resolve(t, "alias", []string{"User admin"}, lines...)
+	expectValue(t, settings, "Port", "2201")
+	expectValue(t, settings, "User", "admin")
+	expectValue(t, settings, "Compression", "no")
+	expectValue(t, settings, "ConnectTimeout", "5")
+
+	settings = resolve(t, "alias", nil, lines...)
+	expectValue(t, settings, "Port", "2202")
+	expectValue(t, settings, "User", "execuser")
+
+	settings = resolve(t, "other", []string{"User admin"}, lines...)
+	expectValue(t, settings, "Port", "22")
+	expectValue(t, settings, "ConnectTimeout", "")
+
+	// Match final blocks are only applied in the second pass, after all the others
+	settings = resolve(t, "host", nil, "Match final", "  User final", "Host *", "  User first")
+	expectValue(t, settings, "User", "first")
+	settings = resolve(t, "host", nil, "Match !final", "  Port 2200", "Match final", "  User final")
+	expectValue(t, settings, "Port", "2200")
+	expectValue(t, settings, "User", "final")
+
+	for _, invalid := range []string{"Match all host x", "Match host", "Match unknown x", "Match"} {
+		if _, err := tryResolve(t, "host", nil, invalid); err == nil {
+			t.Errorf("expected %q to be an error", invalid)
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig(t, dir, "conf.d/10-first.conf", "Port 2201", "User first")
+	writeConfig(t, dir, "conf.d/20-second.conf", "Port 2202", "User second", "Compression yes")
+	writeConfig(t, dir, "conf.d/ignored.txt", "Port 2203")
+	writeConfig(t, dir, "nested.conf", "Include conf.d/20-*.conf", "Host *", "  HostName nested")
+	config, err := Load(writeConfig(t, dir, "config",
+		"Host other",
+		"  Include nested.conf",
+		"Host db",
+		"  Include conf.d/*.conf",
+		"  User third",
+		"Host *",
+		"  Include "+filepath.Join(dir, "nested.conf"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := NewSettings("db")
+	if err := config.Apply(settings); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, settings, "Port", "2201")       // files included in lexical order
+	expectValue(t, settings, "User", "first")      // included before the rest of the block
+	expectValue(t, settings, "Compression", "yes") // from the second file
+	expectValue(t, settings, "HostName", "nested") // nested includes, relative to the top level file
+	settings = NewSettings("web")
+	if err := config.Apply(settings); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, settings, "Port", "2202") // only included by the matching blocks
+
+	// includes are limited in depth, so that a file including itself is an error
+	loop := writeConfig(t, dir, "loop.conf", "Include loop.conf")
+	if _, err := Load(loop); err == nil || !strings.Contains(err.Error(), "nested includes") {
+		t.Errorf("expected an include loop to be an error, got %v", err)
+	}
+	for depth := 0; depth <= maxIncludeDepth; depth++ {
+		writeConfig(t, dir, "deep"+strconv.Itoa(depth)+".conf", "Include deep"+strconv.Itoa(depth+1)+".conf")
+	}
+	writeConfig(t, dir, "deep"+strconv.Itoa(maxIncludeDepth+1)+".conf", "Port 2204")
+	if _, err := Load(filepath.Join(dir, "deep1.conf")); err != nil {
+		t.Errorf("expected %d nested includes to be allowed: %v", maxIncludeDepth, err)
+	}
+	if _, err := Load(filepath.Join(dir, "deep0.conf")); err == nil {
+		t.Errorf("expected more than %d nested includes to be an error", maxIncludeDepth)
+	}
+
+	// missing top level files are skipped, and includes matching nothing are allowed
+	if _, err := Load(filepath.Join(dir, "missing"), writeConfig(t, dir, "none.conf", "Include absent/*")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIgnoreUnknown(t *testing.T) {
+	expectWarnings := func(description string, expected int, lines ...string) {
+		t.Helper()
+		settings := resolve(t, "host", nil, lines...)
+		if warnings := settings.Warnings(); len(warnings) != expected {
+			t.Errorf("expected %d warnings about %s, got %v", expected, description, warnings)
+		}
+	}
+
+	// unknown keywords are skipped with a warning, rather than stopping the proxy from starting
+	settings := resolve(t, "host", nil, "UseKeychain yes", "User tester")
+	expectValue(t, settings, "User", "tester")
+	expectValue(t, settings, "UseKeychain", "")
+	if warnings := settings.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "line 1") ||
+		!strings.Contains(warnings[0].Error(), "usekeychain") {
+		t.Errorf("expected a warning naming the unknown keyword and its line, got %v", warnings)
+	}
+	expectWarnings("keywords matching IgnoreUnknown", 0, "IgnoreUnknown UseKeychain,Other*", "UseKeychain yes",
+		"OtherOption 1")
+	expectWarnings("a keyword not matching IgnoreUnknown", 1, "IgnoreUnknown Other", "UseKeychain yes")
+	expectWarnings("a keyword preceding IgnoreUnknown", 1, "UseKeychain yes", "IgnoreUnknown UseKeychain")
+	// as the OpenSSH client reports them, unknown keywords are warned about even in blocks not applying to the host
+	expectWarnings("a keyword in another host's block", 1, "Host other", "  UseKeychain yes")
+	// and only once, even though "Match final" blocks apply the configuration again
+	expectWarnings("a keyword before a Match final block", 1, "UseKeychain yes", "Match final", "  User tester")
+	// deprecated keywords are accepted
+	expectWarnings("deprecated keywords", 0, "Protocol 2", "UseRoaming no")
+}
+
+func TestExpand(t *testing.T) {
+	localUser, home, uid := currentUser()
+	localHost, _ := os.Hostname()
+	settings := resolve(t, "alias", nil, "Host alias", "  HostName %h.example.com", "  Port 2200", "  User remote")
+	expectValue(t, settings, "HostName", "%h.example.com")
+	if hostName := settings.HostName(); hostName != "alias.example.com" {
+		t.Errorf("expected HostName to expand %%h to the host as given, got %q", hostName)
+	}
+	for value, expected := range map[string]string{
+		"~/.ssh/id_%h":     home + "/.ssh/id_alias.example.com",
+		"~":                home,
+		"/tmp/~/%n":        "/tmp/~/alias",
+		"%r@%h:%p":         "remote@alias.example.com:2200",
+		"%u/%i/%d":         localUser + "/" + uid + "/" + home,
+		"%l":               localHost,
+		"100%%":            "100%",
+		"%z and trailing%": "%z and trailing%",
+	} {
+		if expanded := settings.Expand(value); expanded != expected {
+			t.Errorf("expected %q to expand to %q, got %q", value, expected, expanded)
+		}
+	}
+	if hash := settings.Expand("%C"); len(hash) != 40 {
+		t.Errorf("expected %%C to expand to a SHA-1 hash, got %q", hash)
+	}
+
+	// the local user is the remote user, unless set
+	if remoteUser := resolve(t, "host", nil).Expand("%r"); remoteUser != localUser {
+		t.Errorf("expected %%r to default to the local user %q, got %q", localUser, remoteUser)
+	}
+	files := resolve(t, "host", nil, "IdentityFile ~/.ssh/id_%h", "IdentityFile none").IdentityFiles()
+	if !reflect.DeepEqual(files, []string{home + "/.ssh/id_host"}) {
+		t.Errorf("expected expanded identity files, got %v", files)
+	}
+}
+
+func TestParseAlgorithms(t *testing.T) {
+	defaults := DefaultAlgorithms("MACs")
+	for _, test := range []struct {
+		spec       string
+		algorithms []string // nil if invalid
+	}{
+		{"hmac-sha2-256,hmac-sha1", []string{"hmac-sha2-256", "hmac-sha1"}},
+		{"+hmac-sha1-96", append(append([]string{}, defaults...), "hmac-sha1-96")},
+		{"+hmac-sha1", defaults}, // already among the defaults
+		{"^hmac-sha1,hmac-sha2-512", append([]string{"hmac-sha1", "hmac-sha2-512"},
+			"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256")},
+		{"-hmac-sha1", defaults[:len(defaults)-1]},
+		{"-*-etm@openssh.com,hmac-sha2-512", []string{"hmac-sha2-256", "hmac-sha1"}},
+		{"hmac-md5", nil},
+		{"+hmac-md5", nil},
+	} {
+		algorithms, err := ParseAlgorithms("macs", test.spec)
+		switch {
+		case test.algorithms == nil && err == nil:
+			t.Errorf("%q: expected an error, got %v", test.spec, algorithms)
+		case test.algorithms != nil && !reflect.DeepEqual(algorithms, test.algorithms):
+			t.Errorf("%q: expected %v, got %v (%v)", test.spec, test.algorithms, algorithms, err)
+		}
+	}
+	if _, err := ParseAlgorithms("User", "x"); err == nil {
+		t.Error("expected an error for an option other than an algorithm list")
+	}
+
+	settings := resolve(t, "host", nil, "Ciphers -*-cbc,3des*")
+	if ciphers, err := settings.Algorithms("ciphers"); err != nil || !reflect.DeepEqual(ciphers,
+		DefaultAlgorithms("Ciphers")) {
+		t.Errorf("expected removing algorithms not among the defaults to leave the defaults, got %v (%v)", ciphers,
+			err)
+	}
+	if kex, err := resolve(t, "host", nil).Algorithms("KexAlgorithms"); kex != nil || err != nil {
+		t.Errorf("expected no algorithms for an unset option, got %v (%v)", kex, err)
+	}
+}
+
+func TestDefaultHostKeyAlgorithms(t *testing.T) {
+	// as with OpenSSH, neither SHA-1 signatures with RSA keys nor DSA keys are used unless enabled explicitly
+	defaults := DefaultAlgorithms("HostKeyAlgorithms")
+	for _, legacy := range []string{ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01} {
+		if contains(defaults, legacy) {
+			t.Errorf("expected %s not to be among the default host key algorithms", legacy)
+		}
+	}
+	if !contains(defaults, ssh.KeyAlgoRSASHA512) || !contains(defaults, ssh.KeyAlgoRSASHA256) {
+		t.Errorf("expected RSA keys to be usable with SHA-2 signatures by default, got %v", defaults)
+	}
+	algorithms, err := ParseAlgorithms("HostKeyAlgorithms", "+ssh-rsa,ssh-dss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(algorithms, append(defaults, ssh.KeyAlgoRSA, ssh.KeyAlgoDSA)) {
+		t.Errorf("expected legacy algorithms to be enabled with +, got %v", algorithms)
+	}
+}
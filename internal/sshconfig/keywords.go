@@ -0,0 +1,87 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshconfig
+
+import (
+	"strings"
+)
+
+// keywords are the OpenSSH client configuration keywords, in their documented capitalization.
+var keywords = map[string]string{}
+
+// cumulative keywords accumulate values from every matching directive, rather than keeping the first.
+var cumulative = map[string]bool{
+	"certificatefile": true,
+	"dynamicforward":  true,
+	"identityfile":    true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"sendenv":         true,
+	"setenv":          true,
+}
+
+// aliases are alternative (mostly former) names of keywords.
+var aliases = map[string]string{
+	"challengeresponseauthentication": "KbdInteractiveAuthentication",
+	"hostbasedkeytypes":               "HostbasedAcceptedAlgorithms",
+	"pubkeyacceptedkeytypes":          "PubkeyAcceptedAlgorithms",
+}
+
+func init() {
+	for _, keyword := range []string{
+		"AddKeysToAgent", "AddressFamily", "BatchMode", "BindAddress", "BindInterface", "CanonicalDomains",
+		"CanonicalizeFallbackLocal", "CanonicalizeHostname", "CanonicalizeMaxDots", "CanonicalizePermittedCNAMEs",
+		"CASignatureAlgorithms", "CertificateFile", "ChannelTimeout", "CheckHostIP", "Ciphers", "ClearAllForwardings",
+		"Compression", "ConnectionAttempts", "ConnectTimeout", "ControlMaster", "ControlPath", "ControlPersist",
+		"DynamicForward", "EnableEscapeCommandline", "EnableSSHKeysign", "EscapeChar", "ExitOnForwardFailure",
+		"FingerprintHash", "ForkAfterAuthentication", "ForwardAgent", "ForwardX11", "ForwardX11Timeout",
+		"ForwardX11Trusted", "GatewayPorts", "GlobalKnownHostsFile", "GSSAPIAuthentication",
+		"GSSAPIDelegateCredentials", "HashKnownHosts", "Host", "HostbasedAcceptedAlgorithms",
+		"HostbasedAuthentication", "HostKeyAlgorithms", "HostKeyAlias", "HostName", "IdentitiesOnly",
+		"IdentityAgent", "IdentityFile", "IgnoreUnknown", "Include", "IPQoS", "KbdInteractiveAuthentication",
+		"KbdInteractiveDevices", "KexAlgorithms", "KnownHostsCommand", "LocalCommand", "LocalForward", "LogLevel",
+		"LogVerbose", "MACs", "Match", "NoHostAuthenticationForLocalhost", "NumberOfPasswordPrompts",
+		"ObscureKeystrokeTiming", "PasswordAuthentication", "PermitLocalCommand", "PermitRemoteOpen", "PKCS11Provider",
+		"Port", "PreferredAuthentications", "ProxyCommand", "ProxyJump", "ProxyUseFdpass", "PubkeyAcceptedAlgorithms",
+		"PubkeyAuthentication", "RekeyLimit", "RemoteCommand", "RemoteForward", "RequestTTY", "RequiredRSASize",
+		"RevokedHostKeys", "SecurityKeyProvider", "SendEnv", "ServerAliveCountMax", "ServerAliveInterval", "SessionType",
+		"SetEnv", "StdinNull", "StreamLocalBindMask", "StreamLocalBindUnlink", "StrictHostKeyChecking", "SyslogFacility",
+		"Tag", "TCPKeepAlive", "Tunnel", "TunnelDevice", "UpdateHostKeys", "User", "UserKnownHostsFile",
+		"VerifyHostKeyDNS", "VisualHostKey", "XAuthLocation",
+	} {
+		keywords[strings.ToLower(keyword)] = keyword
+	}
+	// deprecated keywords are accepted, but have no effect
+	for _, keyword := range []string{
+		"Cipher", "CompressionLevel", "FallBackToRsh", "Protocol", "RhostsRSAAuthentication", "RSAAuthentication",
+		"UsePrivilegedPort", "UseRoaming", "UseRsh",
+	} {
+		keywords[strings.ToLower(keyword)] = keyword
+	}
+	for alias, keyword := range aliases {
+		keywords[alias] = keyword
+	}
+}
+
+// Keyword returns the documented capitalization of an OpenSSH client configuration keyword (which are case
+// insensitive), and whether it is one.
+func Keyword(name string) (string, bool) {
+	keyword, ok := keywords[strings.ToLower(name)]
+	return keyword, ok
+}
@@ -0,0 +1,146 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshconfig
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// matchHost evaluates the patterns of a Host directive against the host as given.
+func matchHost(patterns []string, host string) bool {
+	lowered := make([]string, len(patterns))
+	for idx, pattern := range patterns {
+		lowered[idx] = strings.ToLower(pattern)
+	}
+	return matchPatterns(lowered, host)
+}
+
+// matchPatternList evaluates a comma separated list of patterns, optionally ignoring case.
+func matchPatternList(list, value string, fold bool) bool {
+	if fold {
+		list, value = strings.ToLower(list), strings.ToLower(value)
+	}
+	return matchPatterns(strings.Split(list, ","), value)
+}
+
+// matchPatterns matches if any of the patterns matches, and no negated ("!") pattern does.
+func matchPatterns(patterns []string, value string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if matchPattern(value, pattern[1:]) {
+				return false
+			}
+		} else if matchPattern(value, pattern) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPattern matches a wildcard pattern, where "*" matches any sequence of characters and "?" any one character.
+func matchPattern(value, pattern string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for idx := 0; idx <= len(value); idx++ {
+				if matchPattern(value[idx:], pattern) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if value == "" {
+				return false
+			}
+		default:
+			if value == "" || value[0] != pattern[0] {
+				return false
+			}
+		}
+		value, pattern = value[1:], pattern[1:]
+	}
+	return value == ""
+}
+
+// matchCriteria evaluates the criteria of a Match directive, all of which must match. Supported criteria are all,
+// canonical, final, exec, host, originalhost, user and localuser, each of which may be negated with "!".
+func (s *Settings) matchCriteria(d *directive) (bool, error) {
+	result := true
+	args := d.args
+	for idx := 0; idx < len(args); idx++ {
+		criterion := strings.ToLower(args[idx])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		var matched bool
+		switch criterion {
+		case "all":
+			for _, other := range args {
+				switch strings.ToLower(strings.TrimPrefix(other, "!")) {
+				case "all", "canonical", "final":
+				default:
+					return false, d.errorf("Match all cannot be combined with other criteria")
+				}
+			}
+			matched = true
+		case "canonical", "final":
+			// host names are never canonicalized, so the final pass is the only one after canonicalization
+			s.sawFinal = true
+			matched = s.final
+		case "exec", "host", "originalhost", "user", "localuser":
+			if idx+1 == len(args) {
+				return false, d.errorf("Match %s requires an argument", criterion)
+			}
+			idx++
+			argument := args[idx]
+			switch criterion {
+			case "exec":
+				if !result {
+					continue // not worth running when the block cannot match anyway
+				}
+				matched = exec.Command("/bin/sh", "-c", s.Expand(argument)).Run() == nil
+			case "host":
+				matched = matchPatternList(argument, s.HostName(), true)
+			case "originalhost":
+				matched = matchPatternList(argument, s.host, true)
+			case "user":
+				remoteUser := s.User()
+				if remoteUser == "" {
+					remoteUser, _, _ = currentUser()
+				}
+				matched = matchPatternList(argument, remoteUser, false)
+			case "localuser":
+				localUser, _, _ := currentUser()
+				matched = matchPatternList(argument, localUser, false)
+			}
+		default:
+			return false, d.errorf("unsupported Match criterion %q", args[idx])
+		}
+		if matched == negate {
+			result = false
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,299 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshconfig
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPort = 22
+
+// Settings are the client options resolved for a host. As with the OpenSSH client, the first value obtained for an
+// option is kept (so options set from the command line take precedence over configuration files), except for
+// cumulative options such as IdentityFile.
+type Settings struct {
+	host     string // as given, e.g. an alias
+	values   map[string][]string
+	final    bool // evaluating "Match final" blocks
+	sawFinal bool
+	warnings []error
+}
+
+// NewSettings starts resolving the options for a host, as named by the user (which may be an alias).
+func NewSettings(host string) *Settings {
+	return &Settings{
+		host:   strings.ToLower(host),
+		values: map[string][]string{},
+	}
+}
+
+func key(keyword string) string {
+	keyword = strings.ToLower(keyword)
+	if alias, ok := aliases[keyword]; ok {
+		return strings.ToLower(alias)
+	}
+	return keyword
+}
+
+// Set sets an option, unless it is already set; the arguments of cumulative options are appended instead.
+func (s *Settings) Set(keyword string, args ...string) {
+	keyword = key(keyword)
+	if cumulative[keyword] {
+		for _, arg := range args {
+			if !contains(s.values[keyword], arg) {
+				s.values[keyword] = append(s.values[keyword], arg)
+			}
+		}
+	} else if _, set := s.values[keyword]; !set {
+		s.values[keyword] = args
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, existing := range values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSet reports whether an option has been set.
+func (s *Settings) IsSet(keyword string) bool {
+	_, set := s.values[key(keyword)]
+	return set
+}
+
+// Get returns the arguments of an option, separated by spaces, or "" if unset.
+func (s *Settings) Get(keyword string) string {
+	return strings.Join(s.values[key(keyword)], " ")
+}
+
+// Values returns the arguments of an option (for cumulative options, those of every directive setting it).
+func (s *Settings) Values(keyword string) []string {
+	return s.values[key(keyword)]
+}
+
+// Warnings returns the problems with the configuration that were skipped over when applying it, such as unknown
+// keywords.
+func (s *Settings) Warnings() []error {
+	return s.warnings
+}
+
+// Duration interprets an option as an OpenSSH time value: seconds, or a sequence of numbers with units (s, m, h, d
+// or w), e.g. "1h30m". It is zero if unset.
+func (s *Settings) Duration(keyword string) (time.Duration, error) {
+	value := s.Get(keyword)
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := parseTime(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", keyword, value)
+	}
+	return duration, nil
+}
+
+func parseTime(value string) (time.Duration, error) {
+	var total time.Duration
+	for value != "" {
+		digits := 0
+		for digits < len(value) && value[digits] >= '0' && value[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 {
+			return 0, fmt.Errorf("invalid time %q", value)
+		}
+		amount, err := strconv.Atoi(value[:digits])
+		if err != nil {
+			return 0, err
+		}
+		unit := time.Second
+		value = value[digits:]
+		if value != "" {
+			switch value[0] {
+			case 's', 'S':
+			case 'm', 'M':
+				unit = time.Minute
+			case 'h', 'H':
+				unit = time.Hour
+			case 'd', 'D':
+				unit = 24 * time.Hour
+			case 'w', 'W':
+				unit = 7 * 24 * time.Hour
+			default:
+				return 0, fmt.Errorf("invalid time unit %q", value[0])
+			}
+			value = value[1:]
+		}
+		total += time.Duration(amount) * unit
+	}
+	return total, nil
+}
+
+// HostName returns the real host name to connect to: the HostName option (which may refer to the given name as
+// "%h"), or otherwise the host as given.
+func (s *Settings) HostName() string {
+	hostName := s.Get("HostName")
+	if hostName == "" {
+		return s.host
+	}
+	return expandTokens(hostName, map[byte]string{'h': s.host})
+}
+
+// Port returns the port to connect to (by default, 22).
+func (s *Settings) Port() (int, error) {
+	value := s.Get("Port")
+	if value == "" {
+		return defaultPort, nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid Port %q", value)
+	}
+	return port, nil
+}
+
+// User returns the remote user to log in as, or "" if not set.
+func (s *Settings) User() string {
+	return s.Get("User")
+}
+
+// IdentityFiles returns the identity files to authenticate with, with tokens and "~" expanded. The value "none"
+// produces no identity files.
+func (s *Settings) IdentityFiles() []string {
+	return s.files("IdentityFile")
+}
+
+// CertificateFiles returns the certificate files to authenticate with (paired with the identities holding their
+// private keys), with tokens and "~" expanded. The value "none" produces no certificate files.
+func (s *Settings) CertificateFiles() []string {
+	return s.files("CertificateFile")
+}
+
+// IdentityAgents returns the sockets of the SSH agents to authenticate with, in the order they are tried: the value of
+// IdentityAgent, or otherwise that of the SSH_AUTH_SOCK environment variable. Unlike OpenSSH, IdentityAgent takes
+// several sockets. Each is a path (with tokens and "~" expanded), "SSH_AUTH_SOCK", or an environment variable such as
+// "$AGENT_SOCK"; unset environment variables are skipped. The value "none" produces no agents.
+func (s *Settings) IdentityAgents() []string {
+	values := s.Values("IdentityAgent")
+	if !s.IsSet("IdentityAgent") {
+		values = []string{"SSH_AUTH_SOCK"}
+	}
+	var sockets []string
+	for _, value := range values {
+		if strings.EqualFold(value, "none") {
+			return nil
+		}
+		if value == "SSH_AUTH_SOCK" {
+			value = "$SSH_AUTH_SOCK"
+		}
+		if strings.HasPrefix(value, "$") {
+			name := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(value, "$"), "{"), "}")
+			if value = os.Getenv(name); value == "" {
+				continue
+			}
+		} else {
+			value = s.Expand(value)
+		}
+		sockets = append(sockets, value)
+	}
+	return sockets
+}
+
+func (s *Settings) files(keyword string) []string {
+	var files []string
+	for _, file := range s.Values(keyword) {
+		if strings.EqualFold(file, "none") {
+			continue
+		}
+		files = append(files, s.Expand(file))
+	}
+	return files
+}
+
+// Expand expands a leading "~" and the OpenSSH "%" tokens of a path or command: %% (a literal "%"), %C (hash of
+// %l%h%p%r), %d (local home directory), %h (remote host name), %i (local user ID), %L (local host name, without the
+// domain), %l (local host name), %n (host name as given), %p (remote port), %r (remote user) and %u (local user).
+func (s *Settings) Expand(value string) string {
+	localUser, home, uid := currentUser()
+	localHost, _ := os.Hostname()
+	shortHost := localHost
+	if dot := strings.IndexByte(shortHost, '.'); dot >= 0 {
+		shortHost = shortHost[:dot]
+	}
+	port, _ := s.Port()
+	remoteUser := s.User()
+	if remoteUser == "" {
+		remoteUser = localUser
+	}
+	hostName := s.HostName()
+	tokens := map[byte]string{
+		'd': home,
+		'h': hostName,
+		'i': uid,
+		'L': shortHost,
+		'l': localHost,
+		'n': s.host,
+		'p': strconv.Itoa(port),
+		'r': remoteUser,
+		'u': localUser,
+	}
+	tokens['C'] = fmt.Sprintf("%x", sha1.Sum([]byte(localHost+hostName+strconv.Itoa(port)+remoteUser)))
+	if value == "~" || strings.HasPrefix(value, "~/") {
+		value = home + value[1:]
+	}
+	return expandTokens(value, tokens)
+}
+
+// expandTokens replaces "%" tokens; unknown tokens are left as they are.
+func expandTokens(value string, tokens map[byte]string) string {
+	var expanded strings.Builder
+	for idx := 0; idx < len(value); idx++ {
+		if value[idx] != '%' || idx+1 == len(value) {
+			expanded.WriteByte(value[idx])
+			continue
+		}
+		idx++
+		if value[idx] == '%' {
+			expanded.WriteByte('%')
+		} else if replacement, ok := tokens[value[idx]]; ok {
+			expanded.WriteString(replacement)
+		} else {
+			expanded.WriteByte('%')
+			expanded.WriteByte(value[idx])
+		}
+	}
+	return expanded.String()
+}
+
+func currentUser() (name, home, uid string) {
+	home = homeDir()
+	uid = strconv.Itoa(os.Getuid())
+	if current, err := user.Current(); err == nil {
+		return current.Username, home, uid
+	}
+	return os.Getenv("USER"), home, uid
+}
@@ -0,0 +1,88 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"fmt"
+	"time"
+)
+
+// Channels (including agent channels) can only be opened once the downstream client has authenticated, so with
+// ClientAgentAuth, the session authenticates with the target right after the downstream handshake rather than during
+// it. Questions can no longer be relayed to the downstream user by then.
+
+// ClientAgent is the downstream client's forwarded agent, while the session authenticates with the target using it
+// (see ClientAgentAuth); otherwise nil. AuthMethodsProviders should offer its keys before any others.
+func (s *Session) ClientAgent() agent.Agent {
+	return s.clientAgent
+}
+
+// ClientAgentSigners lists the keys of the session's ClientAgent, if any.
+func (s *Session) ClientAgentSigners() []ssh.Signer {
+	if s.clientAgent == nil {
+		return nil
+	}
+	signers, err := s.clientAgent.Signers()
+	if err != nil {
+		s.proxy.logf("%v: listing forwarded agent keys: %v", s.remoteAddr, err)
+		return nil
+	}
+	return signers
+}
+
+// connectWithClientAgent authenticates with the session's target once the downstream client has authenticated to the
+// proxy, using its forwarded agent (if the client forwards one) as well as the configured AuthMethods.
+func (s *Session) connectWithClientAgent(downstream *ssh.ServerConn) error {
+	channel, reqs, err := downstream.OpenChannel("auth-agent@openssh.com", nil)
+	if err == nil {
+		go ssh.DiscardRequests(reqs)
+		s.clientAgent = agent.NewClient(channel)
+		defer func() {
+			s.clientAgent = nil
+			_ = channel.Close()
+		}()
+	} else {
+		s.proxy.logf("%v: no forwarded agent: %v", s.remoteAddr, err)
+	}
+
+	target := s.Target()
+	client, algorithms, err := s.dialUpstream(target)
+	if err != nil {
+		return fmt.Errorf("authenticating with %v: %w", target, err)
+	}
+	return s.setUpstream(client, algorithms)
+}
+
+// refuse turns away a downstream client whose session could not connect to the target, explaining why when it opens
+// its first channel (or after a short wait, if it opens none).
+func (s *Session) refuse(downstream *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request,
+	reason error) {
+	go ssh.DiscardRequests(reqs)
+	select {
+	case channelRequest, ok := <-chans:
+		if ok {
+			_ = channelRequest.Reject(ssh.ConnectionFailed, reason.Error())
+		}
+	case <-time.After(defaultTimeout):
+	}
+	_ = downstream.Close()
+}
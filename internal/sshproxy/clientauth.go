@@ -0,0 +1,197 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+// A ClientKeyChecker verifies a public key (or certificate) presented by a downstream client to the proxy itself. The
+// principal is the user the client is going to authenticate to the target as, which certificates must be valid for.
+type ClientKeyChecker func(conn ssh.ConnMetadata, principal string, key ssh.PublicKey) (*ssh.Permissions, error)
+
+var errClientKeyUnauthorized = errors.New("public key not authorized for this proxy")
+
+type authorizedKey struct {
+	key           ssh.PublicKey
+	certAuthority bool
+	principals    []string // for cert-authority entries, restricts principals accepted (if not empty)
+	from          []string // source address patterns (if not empty)
+}
+
+// AuthorizedKeys produces a ClientKeyChecker accepting the keys listed in an OpenSSH format authorized_keys file, as
+// well as user certificates signed by either the file's "cert-authority" entries or any of the trusted user CA keys.
+// The "from" and "principals" key options are honored; other options are ignored. The file may be empty (""), to only
+// accept certificates.
+func AuthorizedKeys(authorizedKeysFile string, userCAKeys []ssh.PublicKey) (ClientKeyChecker, error) {
+	var entries []*authorizedKey
+	if authorizedKeysFile != "" {
+		var err error
+		if entries, err = parseAuthorizedKeys(authorizedKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, caKey := range userCAKeys {
+		entries = append(entries, &authorizedKey{key: caKey, certAuthority: true})
+	}
+
+	return func(conn ssh.ConnMetadata, principal string, key ssh.PublicKey) (*ssh.Permissions, error) {
+		var authority *authorizedKey
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				for _, entry := range entries {
+					if entry.certAuthority && keysEqual(entry.key, auth) && sourceAllowed(entry.from, conn.RemoteAddr()) {
+						authority = entry
+						return true
+					}
+				}
+				return false
+			},
+			UserKeyFallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				for _, entry := range entries {
+					if !entry.certAuthority && keysEqual(entry.key, key) && sourceAllowed(entry.from, conn.RemoteAddr()) {
+						return &ssh.Permissions{}, nil
+					}
+				}
+				return nil, errClientKeyUnauthorized
+			},
+		}
+
+		cert, isCert := key.(*ssh.Certificate)
+		if !isCert {
+			return checker.UserKeyFallback(conn, key)
+		}
+		if cert.CertType != ssh.UserCert {
+			return nil, fmt.Errorf("certificate is not a user certificate")
+		}
+		if !checker.IsUserAuthority(cert.SignatureKey) {
+			return nil, errClientKeyUnauthorized
+		}
+		if err := checker.CheckCert(principal, cert); err != nil {
+			return nil, err
+		}
+		if len(authority.principals) > 0 && !principalAllowed(authority.principals, cert.ValidPrincipals) {
+			return nil, fmt.Errorf("certificate principals not permitted by authority")
+		}
+		// the library only enforces source-address on completed authentication, but the proxy continues to
+		// authenticate upstream afterwards, so enforce it here
+		if sources, ok := cert.CriticalOptions["source-address"]; ok && !sourceAllowed(strings.Split(sources, ","),
+			conn.RemoteAddr()) {
+			return nil, fmt.Errorf("certificate not valid from source address %v", conn.RemoteAddr())
+		}
+		return &cert.Permissions, nil
+	}, nil
+}
+
+// LoadPublicKeys reads public keys in authorized_keys format (e.g. a TrustedUserCAKeys file), ignoring any options.
+func LoadPublicKeys(filename string) ([]ssh.PublicKey, error) {
+	entries, err := parseAuthorizedKeys(filename)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]ssh.PublicKey, len(entries))
+	for idx, entry := range entries {
+		keys[idx] = entry.key
+	}
+	return keys, nil
+}
+
+func parseAuthorizedKeys(filename string) ([]*authorizedKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*authorizedKey
+	for lineNum, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNum+1, err)
+		}
+		entry := &authorizedKey{key: key}
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			value = strings.Trim(value, `"`)
+			switch strings.ToLower(name) {
+			case "cert-authority":
+				entry.certAuthority = true
+			case "principals":
+				entry.principals = strings.Split(value, ",")
+			case "from":
+				entry.from = strings.Split(value, ",")
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func keysEqual(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// sourceAllowed matches the client address against "from" patterns; negated (!) patterns take precedence.
+func sourceAllowed(patterns []string, addr net.Addr) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	allowed := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		matched := false
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			matched = ip != nil && network.Contains(ip)
+		} else {
+			matched, _ = path.Match(pattern, host)
+		}
+		if matched && negated {
+			return false
+		}
+		allowed = allowed || matched
+	}
+	return allowed
+}
+
+func principalAllowed(permitted []string, principals []string) bool {
+	for _, principal := range principals {
+		for _, candidate := range permitted {
+			if principal == candidate {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"context"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceAllowed(t *testing.T) {
+	for _, test := range []struct {
+		patterns []string
+		address  string
+		allowed  bool
+	}{
+		{nil, "192.0.2.1", true},
+		{[]string{"192.0.2.0/24"}, "192.0.2.1", true},
+		{[]string{"192.0.2.0/24"}, "198.51.100.1", false},
+		{[]string{"2001:db8::/32"}, "2001:db8::1", true},
+		{[]string{"2001:db8::/32"}, "192.0.2.1", false},
+		{[]string{"192.0.2.*"}, "192.0.2.1", true},
+		{[]string{"192.0.2.?"}, "192.0.2.10", false},
+		{[]string{"*"}, "2001:db8::1", true},
+		{[]string{"*.example.com"}, "192.0.2.1", false}, // addresses aren't resolved to names
+		{[]string{"*", "!192.0.2.1"}, "192.0.2.1", false},
+		{[]string{"*", "!192.0.2.1"}, "192.0.2.2", true},
+		{[]string{"!192.0.2.0/24", "192.0.2.1"}, "192.0.2.1", false},
+		{[]string{"!198.51.100.0/24"}, "192.0.2.1", false}, // only negated patterns allow nothing
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(test.address), Port: 22}
+		if allowed := sourceAllowed(test.patterns, addr); allowed != test.allowed {
+			t.Errorf("expected %v from %s to be allowed: %v, was %v", test.patterns, test.address, test.allowed,
+				allowed)
+		}
+	}
+}
+
+// connMetadata is the downstream connection a ClientKeyChecker is consulted for.
+type connMetadata struct {
+	ssh.ConnMetadata
+	remoteAddr net.Addr
+}
+
+func (cm *connMetadata) User() string {
+	return "tester"
+}
+
+func (cm *connMetadata) RemoteAddr() net.Addr {
+	return cm.remoteAddr
+}
+
+func newClientKey(t *testing.T) ssh.Signer {
+	key, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeAuthorizedKeys writes an authorized_keys file of the lines, returning its path.
+func writeAuthorizedKeys(t *testing.T, lines ...string) string {
+	authorizedKeys := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(authorizedKeys, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return authorizedKeys
+}
+
+func authorizedKeysLine(options string, key ssh.PublicKey) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if options != "" {
+		line = options + " " + line
+	}
+	return line
+}
+
+// signUserCert issues a user certificate for the key, valid for the principals from an hour ago until the expiry.
+func signUserCert(t *testing.T, authority ssh.Signer, key ssh.PublicKey, principals []string, expiry time.Time,
+	criticalOptions map[string]string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(expiry.Unix()),
+		Permissions:     ssh.Permissions{CriticalOptions: criticalOptions},
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAuthorizedKeysFrom(t *testing.T) {
+	anywhere, restricted := newClientKey(t), newClientKey(t)
+	checker, err := AuthorizedKeys(writeAuthorizedKeys(t,
+		"# comments and blank lines are skipped",
+		"",
+		authorizedKeysLine("", anywhere.PublicKey()),
+		authorizedKeysLine(`from="192.0.2.0/24,!192.0.2.13"`, restricted.PublicKey()),
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		key      ssh.Signer
+		address  string
+		accepted bool
+	}{
+		{anywhere, "198.51.100.1", true},
+		{restricted, "192.0.2.1", true},
+		{restricted, "192.0.2.13", false},
+		{restricted, "198.51.100.1", false},
+		{newClientKey(t), "192.0.2.1", false},
+	} {
+		conn := &connMetadata{remoteAddr: &net.TCPAddr{IP: net.ParseIP(test.address), Port: 22}}
+		if _, err := checker(conn, "tester", test.key.PublicKey()); (err == nil) != test.accepted {
+			t.Errorf("expected key %s from %s to be accepted: %v, got %v", ssh.FingerprintSHA256(test.key.PublicKey()),
+				test.address, test.accepted, err)
+		}
+	}
+}
+
+func TestAuthorizedKeysCertificates(t *testing.T) {
+	fileCA, trustedCA, restrictedCA, untrustedCA := newClientKey(t), newClientKey(t), newClientKey(t),
+		newClientKey(t)
+	checker, err := AuthorizedKeys(writeAuthorizedKeys(t,
+		authorizedKeysLine("cert-authority", fileCA.PublicKey()),
+		authorizedKeysLine(`cert-authority,principals="alice,bob",from="192.0.2.0/24"`, restrictedCA.PublicKey()),
+	), []ssh.PublicKey{trustedCA.PublicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newClientKey(t).PublicKey()
+	valid := time.Now().Add(time.Hour)
+	hostCert := signUserCert(t, fileCA, key, []string{"tester"}, valid, nil)
+	hostCert.CertType = ssh.HostCert
+	if err := hostCert.SignCert(rand.Reader, fileCA); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		cert      *ssh.Certificate
+		principal string
+		address   string
+		accepted  bool
+	}{
+		{"file authority", signUserCert(t, fileCA, key, []string{"tester"}, valid, nil), "tester", "198.51.100.1",
+			true},
+		{"trusted authority", signUserCert(t, trustedCA, key, []string{"tester"}, valid, nil), "tester",
+			"198.51.100.1", true},
+		{"untrusted authority", signUserCert(t, untrustedCA, key, []string{"tester"}, valid, nil), "tester",
+			"198.51.100.1", false},
+		{"expired", signUserCert(t, fileCA, key, []string{"tester"}, time.Now().Add(-time.Minute), nil), "tester",
+			"198.51.100.1", false},
+		{"wrong principal", signUserCert(t, fileCA, key, []string{"someone"}, valid, nil), "tester",
+			"198.51.100.1", false},
+		{"host certificate", hostCert, "tester", "198.51.100.1", false},
+		{"source address", signUserCert(t, fileCA, key, []string{"tester"}, valid,
+			map[string]string{"source-address": "192.0.2.0/24"}), "tester", "192.0.2.1", true},
+		{"wrong source address", signUserCert(t, fileCA, key, []string{"tester"}, valid,
+			map[string]string{"source-address": "192.0.2.0/24"}), "tester", "198.51.100.1", false},
+		{"permitted principal", signUserCert(t, restrictedCA, key, []string{"alice"}, valid, nil), "alice",
+			"192.0.2.1", true},
+		{"principal not permitted by authority", signUserCert(t, restrictedCA, key, []string{"carol"}, valid, nil),
+			"carol", "192.0.2.1", false},
+		{"authority not trusted from address", signUserCert(t, restrictedCA, key, []string{"alice"}, valid, nil),
+			"alice", "198.51.100.1", false},
+	} {
+		conn := &connMetadata{remoteAddr: &net.TCPAddr{IP: net.ParseIP(test.address), Port: 22}}
+		if _, err := checker(conn, test.principal, test.cert); (err == nil) != test.accepted {
+			t.Errorf("%s: expected the certificate to be accepted: %v, got %v", test.name, test.accepted, err)
+		}
+	}
+}
+
+// TestRequireClientKey authenticates downstream clients to the proxy itself: a client key accepted by the
+// ClientKeyChecker is only a partial success, after which keyboard-interactive authentication relays authentication
+// with the target. With RequireClientKey, clients cannot skip the key.
+func TestRequireClientKey(t *testing.T) {
+	connected, disconnected := make(chan interface{}, 10), make(chan interface{}, 10)
+	target := runTarget(t, connected, disconnected)
+	clientKey := newClientKey(t)
+	checker, err := AuthorizedKeys(writeAuthorizedKeys(t, authorizedKeysLine("", clientKey.PublicKey())), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := make(chan ssh.PublicKey, 10)
+	proxy, err := NewProxy(target, &ProxyConfig{
+		KeyProvider:      EphemeralHostKey,
+		TargetKeyChecker: FixedKeyChecker(ssh.InsecureIgnoreHostKey()),
+		ClientKeyChecker: checker,
+		RequireClientKey: true,
+		AuthMethods: func(session *Session) []ssh.AuthMethod {
+			verified <- session.ClientKey()
+			return DefaultAuthMethods(session)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = proxy.Serve(context.Background(), listener) }()
+	defer func() { _ = proxy.Close() }()
+
+	dial := func(auth ...ssh.AuthMethod) error {
+		client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            "tester",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Auth:            auth,
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			_ = client.Close()
+		}
+		return err
+	}
+
+	interactive := ssh.KeyboardInteractive(blankInteractive)
+	if err := dial(ssh.PublicKeys(clientKey), interactive); err != nil {
+		t.Fatalf("expected a client with an authorized key to authenticate: %v", err)
+	}
+	select {
+	case key := <-verified:
+		if key == nil || !keysEqual(key, clientKey.PublicKey()) {
+			t.Errorf("expected the session to be verified with the client's key, got %v", key)
+		}
+	default:
+		t.Error("expected authentication with the target")
+	}
+
+	if err := dial(interactive); err == nil {
+		t.Error("expected a client without a key to be refused")
+	}
+	if err := dial(ssh.PublicKeys(newClientKey(t)), interactive); err == nil {
+		t.Error("expected a client with an unauthorized key to be refused")
+	}
+	if err := dial(ssh.PublicKeys(clientKey)); err == nil {
+		t.Error("expected a client unable to continue with keyboard-interactive authentication to be refused")
+	}
+	if len(verified) > 0 {
+		t.Error("expected no authentication with the target for refused clients")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// An UpstreamDialer opens the network connection to an upstream address on behalf of a session. The SSH client
+// connection to the target is then established over it.
+type UpstreamDialer func(session *Session, network, address string) (net.Conn, error)
+
+// DirectDialer connects directly to the address, within the proxy's ConnectTimeout.
+func DirectDialer(session *Session, network, address string) (net.Conn, error) {
+	timeout := defaultTimeout
+	if session != nil && session.config.ConnectTimeout > 0 {
+		timeout = session.config.ConnectTimeout
+	}
+	return net.DialTimeout(network, address, timeout)
+}
+
+// A JumpHost is an intermediate SSH server (bastion) that connections to the target are tunneled through.
+type JumpHost struct {
+	User    string // if empty, the user the session authenticates to the target as
+	Address string // host:port
+}
+
+func (jh *JumpHost) String() string {
+	if jh.User == "" {
+		return jh.Address
+	}
+	return fmt.Sprintf("%s@%s", jh.User, jh.Address)
+}
+
+// ParseJumpHosts parses a comma separated list of jump hosts in the format of OpenSSH's ProxyJump option, i.e.
+// "[user@]host[:port],...". The value "none" produces an empty list.
+func ParseJumpHosts(spec string, defaultPort int) ([]*JumpHost, error) {
+	if spec == "" || strings.EqualFold(spec, "none") {
+		return nil, nil
+	}
+	var hops []*JumpHost
+	for _, hop := range strings.Split(spec, ",") {
+		hop = strings.TrimPrefix(strings.TrimSpace(hop), "ssh://")
+		user := ""
+		if at := strings.LastIndex(hop, "@"); at >= 0 {
+			user, hop = hop[:at], hop[at+1:]
+		}
+		host, port, err := net.SplitHostPort(hop)
+		if err != nil {
+			host, port = strings.Trim(hop, "[]"), strconv.Itoa(defaultPort)
+		}
+		if host == "" {
+			return nil, fmt.Errorf("invalid jump host %q", hop)
+		}
+		if portNum, err := strconv.Atoi(port); err != nil || portNum < 1 || portNum > 65535 {
+			return nil, fmt.Errorf("invalid jump host port %q", port)
+		}
+		hops = append(hops, &JumpHost{
+			User:    user,
+			Address: net.JoinHostPort(host, port),
+		})
+	}
+	return hops, nil
+}
+
+// JumpDialer tunnels connections through each of the jump hosts in turn, using direct-tcpip channels. The first hop is
+// reached with the dialer (or DirectDialer, if nil). Each hop is authenticated with the session's client configuration,
+// including verification of its own host key.
+func JumpDialer(hops []*JumpHost, dialer UpstreamDialer) UpstreamDialer {
+	if dialer == nil {
+		dialer = DirectDialer
+	}
+	if len(hops) == 0 {
+		return dialer
+	}
+	return func(session *Session, network, address string) (net.Conn, error) {
+		var clients []*ssh.Client
+		closeClients := func() {
+			for idx := len(clients) - 1; idx >= 0; idx-- {
+				_ = clients[idx].Close()
+			}
+		}
+
+		for _, hop := range hops {
+			var conn net.Conn
+			var err error
+			if len(clients) == 0 {
+				conn, err = dialer(session, "tcp", hop.Address)
+			} else {
+				conn, err = clients[len(clients)-1].Dial("tcp", hop.Address)
+			}
+			if err != nil {
+				closeClients()
+				return nil, fmt.Errorf("jump host %v: %w", hop, err)
+			}
+
+			user := hop.User
+			if user == "" && session.Target() != nil {
+				user = session.Target().User
+			}
+			clientConn, chans, reqs, err := ssh.NewClientConn(conn, hop.Address, session.ClientConfig(user, hop.Address))
+			session.closeAuthResources()
+			if err != nil {
+				_ = conn.Close()
+				closeClients()
+				return nil, fmt.Errorf("jump host %v: %w", hop, err)
+			}
+			clients = append(clients, ssh.NewClient(clientConn, chans, reqs))
+		}
+
+		conn, err := clients[len(clients)-1].Dial(network, address)
+		if err != nil {
+			closeClients()
+			return nil, fmt.Errorf("jump host %v: %w", hops[len(hops)-1], err)
+		}
+		return &jumpConn{Conn: conn, clients: clients}, nil
+	}
+}
+
+// jumpConn is a connection tunneled through jump hosts, which disconnects from them when closed.
+type jumpConn struct {
+	net.Conn
+	clients []*ssh.Client
+}
+
+func (jc *jumpConn) Close() error {
+	err := jc.Conn.Close()
+	for idx := len(jc.clients) - 1; idx >= 0; idx-- {
+		_ = jc.clients[idx].Close()
+	}
+	return err
+}
@@ -0,0 +1,185 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseJumpHosts(t *testing.T) {
+	for _, test := range []struct {
+		spec     string
+		expected []*JumpHost
+		err      bool
+	}{
+		{"", nil, false},
+		{"none", nil, false},
+		{"bastion", []*JumpHost{{Address: "bastion:22"}}, false},
+		{"ops@bastion:2222", []*JumpHost{{User: "ops", Address: "bastion:2222"}}, false},
+		{"ssh://ops@bastion:2222", []*JumpHost{{User: "ops", Address: "bastion:2222"}}, false},
+		{"first.example.com, ops@second.example.com:2022,third",
+			[]*JumpHost{{Address: "first.example.com:22"}, {User: "ops", Address: "second.example.com:2022"},
+				{Address: "third:22"}}, false},
+		// user names may contain an @ of their own; the host is after the last one
+		{"ops@corp@bastion", []*JumpHost{{User: "ops@corp", Address: "bastion:22"}}, false},
+		{"[2001:db8::1]:2222", []*JumpHost{{Address: "[2001:db8::1]:2222"}}, false},
+		{"ops@[2001:db8::1]", []*JumpHost{{User: "ops", Address: "[2001:db8::1]:22"}}, false},
+		{"[2001:db8::1]", []*JumpHost{{Address: "[2001:db8::1]:22"}}, false},
+		{"bastion:0", nil, true},
+		{"bastion:65536", nil, true},
+		{"bastion:ssh", nil, true},
+		{"ops@", nil, true},
+		{"bastion,,other", nil, true},
+		{"[]:22", nil, true},
+	} {
+		hops, err := ParseJumpHosts(test.spec, 22)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.spec, hops)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(hops, test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.spec, test.expected, hops)
+		}
+	}
+}
+
+type directTCPIPPayload struct {
+	Host       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// runJumpHost runs an SSH server accepting any client, which relays direct-tcpip channels to their destination,
+// reporting each one on dialed as "user@host:port".
+func runJumpHost(t *testing.T, dialed chan<- string) net.Addr {
+	hostKey, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				defer func() { _ = serverConn.Close() }()
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					var payload directTCPIPPayload
+					if nc.ChannelType() != "direct-tcpip" || ssh.Unmarshal(nc.ExtraData(), &payload) != nil {
+						_ = nc.Reject(ssh.Prohibited, "direct-tcpip only")
+						continue
+					}
+					address := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+					dialed <- serverConn.User() + "@" + address
+					upstream, err := net.Dial("tcp", address)
+					if err != nil {
+						_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					channel, requests, err := nc.Accept()
+					if err != nil {
+						_ = upstream.Close()
+						continue
+					}
+					go ssh.DiscardRequests(requests)
+					go func() {
+						_, _ = io.Copy(channel, upstream)
+						_ = channel.Close()
+					}()
+					go func() {
+						_, _ = io.Copy(upstream, channel)
+						_ = upstream.Close()
+					}()
+				}
+			}()
+		}
+	}()
+	return listener.Addr()
+}
+
+func expectDialed(t *testing.T, dialed <-chan string, expected string) {
+	t.Helper()
+	select {
+	case destination := <-dialed:
+		if destination != expected {
+			t.Errorf("expected a connection to %s, got %s", expected, destination)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for a connection to %s", expected)
+	}
+}
+
+func TestJumpDialer(t *testing.T) {
+	connected := make(chan interface{}, 10)
+	target := runTarget(t, connected, make(chan interface{}, 10))
+	firstDialed, secondDialed := make(chan string, 10), make(chan string, 10)
+	first, second := runJumpHost(t, firstDialed), runJumpHost(t, secondDialed)
+
+	// the first hop is logged into as its own user, the second as the target's (the downstream client's)
+	hops, err := ParseJumpHosts("ops@"+first.String()+","+second.String(), 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := serveProxy(t, target, &ProxyConfig{UpstreamDialer: JumpDialer(hops, nil)})
+	if err := dialClient(address, blankInteractive); err != nil {
+		t.Fatal(err)
+	}
+	expectDialed(t, firstDialed, "ops@"+second.String())
+	expectDialed(t, secondDialed, "tester@"+target.String())
+	expectSignal(t, connected, "the target to be connected to through the jump hosts")
+
+	// failing to reach the first hop is reported as such
+	unreachable := errors.New("unreachable")
+	_, err = JumpDialer(hops, func(_ *Session, _, _ string) (net.Conn, error) {
+		return nil, unreachable
+	})(nil, "tcp", target.String())
+	if !errors.Is(err, unreachable) || !strings.Contains(err.Error(), "jump host ops@"+first.String()) {
+		t.Errorf("expected the first jump host to be named as unreachable, got %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Remote port forwarding, end to end: a downstream client asks (through the proxy) for the upstream server to forward
+// a port or socket; the upstream server then opens forwarded channels, which the proxy must relay back downstream.
+
+const forwardedPort = 4242
+
+type forwardRequest struct {
+	Addr string
+	Port uint32
+}
+
+type forwardedTCPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+type streamLocalRequest struct {
+	SocketPath string
+}
+
+type forwardedStreamLocalPayload struct {
+	SocketPath string
+	Reserved   string
+}
+
+// openForwardedRequest asks the forwarding server to open the channel for the most recent forward. Until then the
+// downstream client may not yet be ready to accept it, having only just received the reply to its forward request.
+const openForwardedRequest = "open-forwarded@test"
+
+// runForwardingServer runs an upstream SSH server accepting one connection, which honors (tcpip|streamlocal)-forward
+// requests by opening a forwarded channel (once asked to, with an openForwardedRequest), writing a greeting to it, and
+// expecting the greeting to be echoed back.
+func runForwardingServer(t *testing.T, greeting string, echoed chan<- string) net.Addr {
+	hostKey, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		defer func() { _ = serverConn.Close() }()
+		go func() {
+			for nc := range chans {
+				_ = nc.Reject(ssh.Prohibited, "no channels")
+			}
+		}()
+
+		openForwarded := func(channelType string, payload []byte) {
+			channel, requests, err := serverConn.OpenChannel(channelType, payload)
+			if err != nil {
+				echoed <- "open failed: " + err.Error()
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			defer func() { _ = channel.Close() }()
+			if _, err := channel.Write([]byte(greeting)); err != nil {
+				echoed <- "write failed: " + err.Error()
+				return
+			}
+			reply := make([]byte, len(greeting))
+			if _, err := io.ReadFull(channel, reply); err != nil {
+				echoed <- "read failed: " + err.Error()
+				return
+			}
+			echoed <- string(reply)
+		}
+
+		var pending func()
+		for req := range reqs {
+			switch req.Type {
+			case "tcpip-forward":
+				var forward forwardRequest
+				if err := ssh.Unmarshal(req.Payload, &forward); err != nil {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				_ = req.Reply(true, ssh.Marshal(&struct{ Port uint32 }{forwardedPort}))
+				pending = func() {
+					openForwarded("forwarded-tcpip", ssh.Marshal(&forwardedTCPPayload{
+						Addr:       forward.Addr,
+						Port:       forwardedPort,
+						OriginAddr: "192.0.2.1",
+						OriginPort: 54321,
+					}))
+				}
+			case "streamlocal-forward@openssh.com":
+				var forward streamLocalRequest
+				if err := ssh.Unmarshal(req.Payload, &forward); err != nil {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				_ = req.Reply(true, nil)
+				pending = func() {
+					openForwarded("forwarded-streamlocal@openssh.com", ssh.Marshal(&forwardedStreamLocalPayload{
+						SocketPath: forward.SocketPath,
+					}))
+				}
+			case openForwardedRequest:
+				_ = req.Reply(pending != nil, nil)
+				if pending != nil {
+					go pending()
+				}
+			default:
+				if req.WantReply {
+					_ = req.Reply(false, nil)
+				}
+			}
+		}
+	}()
+	return listener.Addr()
+}
+
+// dialThroughProxy starts a proxy to the target, and connects a downstream client to it.
+func dialThroughProxy(t *testing.T, target net.Addr) *ssh.Client {
+	return dialThroughProxyChecking(t, target, FixedKeyChecker(ssh.InsecureIgnoreHostKey()))
+}
+
+// dialThroughProxyChecking is dialThroughProxy, verifying the target's host key with the checker.
+func dialThroughProxyChecking(t *testing.T, target net.Addr, checker TargetKeyCheckerProvider) *ssh.Client {
+	proxy, err := NewProxy(target, &ProxyConfig{
+		KeyProvider:      EphemeralHostKey,
+		TargetKeyChecker: checker,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = proxy.Serve(context.Background(), listener) }()
+	t.Cleanup(func() { _ = proxy.Close() })
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "tester",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth:            []ssh.AuthMethod{ssh.KeyboardInteractive(blankInteractive)},
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// echoForwarded accepts one forwarded connection from the listener, and echoes the greeting back, after asking the
+// server to open it.
+func echoForwarded(t *testing.T, client *ssh.Client, listener net.Listener, greeting string) {
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		buffer := make([]byte, len(greeting))
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return
+		}
+		_, _ = conn.Write(buffer)
+	}()
+	if ok, _, err := client.SendRequest(openForwardedRequest, true, nil); err != nil || !ok {
+		t.Fatalf("expected the server to open the forwarded channel: %v", err)
+	}
+}
+
+func expectEcho(t *testing.T, echoed <-chan string, greeting string) {
+	select {
+	case reply := <-echoed:
+		if reply != greeting {
+			t.Fatalf("expected %q echoed through the proxy, got %q", greeting, reply)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the forwarded channel")
+	}
+}
+
+func TestRemoteForwardTCP(t *testing.T) {
+	greeting := "hello from a forwarded port"
+	echoed := make(chan string, 1)
+	client := dialThroughProxy(t, runForwardingServer(t, greeting, echoed))
+
+	listener, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	if port := listener.Addr().(*net.TCPAddr).Port; port != forwardedPort {
+		t.Fatalf("expected the upstream's allocated port %d, got %d", forwardedPort, port)
+	}
+
+	echoForwarded(t, client, listener, greeting)
+	expectEcho(t, echoed, greeting)
+}
+
+func TestRemoteForwardStreamLocal(t *testing.T) {
+	greeting := "hello from a forwarded socket"
+	echoed := make(chan string, 1)
+	client := dialThroughProxy(t, runForwardingServer(t, greeting, echoed))
+
+	listener, err := client.ListenUnix(filepath.Join(t.TempDir(), "forwarded.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	echoForwarded(t, client, listener, greeting)
+	expectEcho(t, echoed, greeting)
+}
+
+// acceptChangedKeys accepts any host key, as a changed one (as StrictHostKeyChecking=no does).
+func acceptChangedKeys(session *Session) ssh.HostKeyCallback {
+	return func(_ string, _ net.Addr, _ ssh.PublicKey) error {
+		session.AcceptChangedHostKey()
+		return nil
+	}
+}
+
+func TestForwardingRefusedAfterHostKeyChange(t *testing.T) {
+	echoed := make(chan string, 1)
+	client := dialThroughProxyChecking(t, runForwardingServer(t, "unused", echoed), acceptChangedKeys)
+
+	if listener, err := client.Listen("tcp", "127.0.0.1:0"); err == nil {
+		_ = listener.Close()
+		t.Fatal("expected remote forwarding to be refused for a target with a changed host key")
+	}
+	if conn, err := client.Dial("tcp", "127.0.0.1:22"); err == nil {
+		_ = conn.Close()
+		t.Fatal("expected local forwarding to be refused for a target with a changed host key")
+	} else if openErr, ok := err.(*ssh.OpenChannelError); !ok || openErr.Reason != ssh.Prohibited {
+		t.Fatalf("expected local forwarding to be prohibited, got %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EphemeralHostKey provides a single newly generated ed25519 host key, which is lost when the proxy exits.
+func EphemeralHostKey() ([]ssh.Signer, error) {
+	signer, err := GenHostKey()
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.Signer{signer}, nil
+}
+
+// HostKeyFiles provides host keys loaded from private key files (in OpenSSH or PEM format, unencrypted). If generate is
+// set, missing files are created with a new key, of the type named in the file name as OpenSSH does (e.g.
+// "ssh_host_rsa_key", "ssh_host_ecdsa_key"; otherwise ed25519), along with a ".pub" public key file. A host certificate
+// for a key found alongside it (as "<key file>-cert.pub") is presented in addition to the plain key.
+func HostKeyFiles(paths []string, generate bool) HostKeyProvider {
+	return func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		for _, path := range paths {
+			signer, err := loadHostKey(path)
+			if errors.Is(err, os.ErrNotExist) && generate {
+				signer, err = generateHostKey(path)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("host key %s: %w", path, err)
+			}
+			certSigner, err := loadHostCertificate(path+"-cert.pub", signer)
+			if err != nil {
+				return nil, fmt.Errorf("host certificate %s-cert.pub: %w", path, err)
+			}
+			if certSigner != nil {
+				signers = append(signers, certSigner)
+			}
+			signers = append(signers, signer)
+		}
+		if len(signers) == 0 {
+			return nil, errors.New("no host keys specified")
+		}
+		return signers, nil
+	}
+}
+
+func loadHostKey(path string) (ssh.Signer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("permissions %#o are too open; host keys must only be accessible by their owner",
+			info.Mode().Perm())
+	}
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(keyBytes)
+}
+
+// loadHostCertificate loads a host certificate for the signer's key, if the file exists.
+func loadHostCertificate(path string, signer ssh.Signer) (ssh.Signer, error) {
+	certBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not a certificate")
+	}
+	if cert.CertType != ssh.HostCert {
+		return nil, errors.New("not a host certificate")
+	}
+	return ssh.NewCertSigner(cert, signer) // fails if the certificate is for another key
+}
+
+// SignHostCertificate issues a host certificate for the public key, signed by the certificate authority, valid for the
+// principals (host names clients connect to) for the validity duration from now (or forever, if zero).
+func SignHostCertificate(authority ssh.Signer, key ssh.PublicKey, keyID string, principals []string,
+	validity time.Duration) (*ssh.Certificate, error) {
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.HostCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      0,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if validity > 0 {
+		now := time.Now()
+		cert.ValidAfter = uint64(now.Add(-5 * time.Minute).Unix()) // tolerate some clock skew
+		cert.ValidBefore = uint64(now.Add(validity).Unix())
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func generateHostKey(path string) (ssh.Signer, error) {
+	var privateKey crypto.Signer
+	var err error
+	switch name := strings.ToLower(filepath.Base(path)); {
+	case strings.Contains(name, "rsa"):
+		privateKey, err = rsa.GenerateKey(rand.Reader, 3072)
+	case strings.Contains(name, "ecdsa"):
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromSigner(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, "nosshtradamus host key")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// never overwrite a key that appeared in the meantime (e.g. another instance starting concurrently)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(file, block); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	_ = os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+	return signer, nil
+}
+
+// DerivedHostKey provides an ed25519 host key derived deterministically from a master secret and the target address, so
+// that a proxy (or several proxies sharing the secret) presents a distinct, stable host key for each target it serves.
+// The target must be known before key exchange, so this only applies to a proxy's static target, or to the target of a
+// Route (one target per listener); targets named by the client's username are only known after key exchange.
+func DerivedHostKey(secret []byte, target string) HostKeyProvider {
+	return func() ([]ssh.Signer, error) {
+		if len(secret) < 32 {
+			return nil, errors.New("host key secret must be at least 32 bytes")
+		}
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, secret)
+		_, _ = mac.Write([]byte("nosshtradamus derived host key\x00"))
+		_, _ = mac.Write([]byte(net.JoinHostPort(strings.ToLower(host), port)))
+		signer, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(mac.Sum(nil)))
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.Signer{signer}, nil
+	}
+}
+
+// LoadHostKeySecret reads the master secret for derived host keys from a file, which is created with 32 random bytes
+// if missing.
+func LoadHostKeySecret(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = file.Write(secret)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(path)
+			return nil, err
+		}
+		return secret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s: permissions %#o are too open; the secret must only be accessible by its owner",
+			path, info.Mode().Perm())
+	}
+	return os.ReadFile(path)
+}
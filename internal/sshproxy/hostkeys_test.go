@@ -0,0 +1,314 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// presentedHostKey connects to the proxy at the address, returning the host key it presented.
+func presentedHostKey(t *testing.T, address string) ssh.PublicKey {
+	var presented ssh.PublicKey
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User: "tester",
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			presented = key
+			return nil
+		},
+		Auth:    []ssh.AuthMethod{ssh.KeyboardInteractive(blankInteractive)},
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	return presented
+}
+
+func TestDerivedHostKeyRoutes(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x5a}, 32)
+	connected := map[net.Addr]chan interface{}{}
+	runRecordedTarget := func() net.Addr {
+		signal := make(chan interface{}, 10)
+		target := runTarget(t, signal, make(chan interface{}, 10))
+		connected[target] = signal
+		return target
+	}
+	db, web := runRecordedTarget(), runRecordedTarget()
+
+	proxy, err := NewProxy(nil, &ProxyConfig{
+		KeyProvider:      EphemeralHostKey,
+		TargetKeyChecker: FixedKeyChecker(ssh.InsecureIgnoreHostKey()),
+		TargetResolver: func(_ ssh.ConnMetadata) (*Target, error) {
+			t.Error("expected each listener's own target to be used")
+			return StaticTarget(db)(nil)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = proxy.Close() })
+	var routes []*Route
+	addresses := map[string]string{}
+	for _, target := range []net.Addr{db, web} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses[target.String()] = listener.Addr().String()
+		routes = append(routes, &Route{
+			Listener:       listener,
+			TargetResolver: StaticHostTarget(target.String()),
+			KeyProvider:    DerivedHostKey(secret, target.String()),
+		})
+	}
+	go func() { _ = proxy.ServeRoutes(context.Background(), routes) }()
+
+	presented := map[string]string{}
+	for _, target := range []net.Addr{db, web} {
+		key := presentedHostKey(t, addresses[target.String()])
+		expectSignal(t, connected[target], "the listener's own target to be connected to")
+		derived, err := DerivedHostKey(secret, target.String())()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key.Marshal(), derived[0].PublicKey().Marshal()) {
+			t.Errorf("expected the listener for %v to present the key derived for it", target)
+		}
+		presented[string(key.Marshal())] = target.String()
+	}
+	if len(presented) != 2 {
+		t.Fatal("expected each listener to present a host key of its own")
+	}
+
+	// the same secret and target always derive the same key, whatever the case of the host name
+	first, err := DerivedHostKey(secret, "DB01.example.com:22")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := DerivedHostKey(secret, "db01.example.com:22")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := DerivedHostKey(secret, "db01.example.com:2222")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first[0].PublicKey().Marshal(), second[0].PublicKey().Marshal()) {
+		t.Error("expected derived keys to be stable")
+	}
+	if bytes.Equal(first[0].PublicKey().Marshal(), other[0].PublicKey().Marshal()) {
+		t.Error("expected a different port to derive a different key")
+	}
+	if _, err := DerivedHostKey(secret[:16], "db01.example.com:22")(); err == nil {
+		t.Error("expected a short secret to be refused")
+	}
+}
+
+func expectMode(t *testing.T, path string, mode os.FileMode) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("expected %s to have mode %#o, got %#o", path, mode, info.Mode().Perm())
+	}
+}
+
+func TestHostKeyFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	paths := []string{filepath.Join(dir, "ssh_host_ecdsa_key"), filepath.Join(dir, "ssh_host_ed25519_key")}
+	if _, err := HostKeyFiles(paths, false)(); err == nil {
+		t.Fatal("expected missing host keys not to be generated unless asked to")
+	}
+
+	// on the first run, keys of the types named by the files are generated, readable only by their owner
+	generated, err := HostKeyFiles(paths, true)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != 2 || generated[0].PublicKey().Type() != ssh.KeyAlgoECDSA256 ||
+		generated[1].PublicKey().Type() != ssh.KeyAlgoED25519 {
+		t.Fatalf("expected an ECDSA and an ed25519 host key, got %d keys", len(generated))
+	}
+	expectMode(t, dir, 0700)
+	for idx, path := range paths {
+		expectMode(t, path, 0600)
+		expectMode(t, path+".pub", 0644)
+		pubBytes, err := os.ReadFile(path + ".pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBytes)
+		if err != nil || !bytes.Equal(pub.Marshal(), generated[idx].PublicKey().Marshal()) {
+			t.Errorf("expected %s.pub to hold the generated public key (%v)", path, err)
+		}
+	}
+
+	// later runs load the same keys, whether or not generating missing ones
+	for _, generate := range []bool{true, false} {
+		loaded, err := HostKeyFiles(paths, generate)()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for idx := range paths {
+			if !bytes.Equal(loaded[idx].PublicKey().Marshal(), generated[idx].PublicKey().Marshal()) {
+				t.Errorf("expected %s to be reloaded, not replaced", paths[idx])
+			}
+		}
+	}
+
+	// keys others can read are refused
+	if err := os.Chmod(paths[0], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := HostKeyFiles(paths[:1], true)(); err == nil || !strings.Contains(err.Error(), "too open") {
+		t.Errorf("expected a host key readable by others to be refused, got %v", err)
+	}
+}
+
+func TestSignHostCertificate(t *testing.T) {
+	authority, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(key ssh.PublicKey, _ string) bool {
+			return bytes.Equal(key.Marshal(), authority.PublicKey().Marshal())
+		},
+	}
+	address := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	principals := []string{"proxy.example.com", "proxy"}
+
+	for _, validity := range []time.Duration{0, time.Hour} {
+		before := time.Now()
+		cert, err := SignHostCertificate(authority, hostKey.PublicKey(), "nosshtradamus", principals, validity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.CertType != ssh.HostCert || cert.KeyId != "nosshtradamus" ||
+			!bytes.Equal(cert.Key.Marshal(), hostKey.PublicKey().Marshal()) ||
+			strings.Join(cert.ValidPrincipals, ",") != "proxy.example.com,proxy" {
+			t.Errorf("%v: expected a host certificate for the key and principals, got %+v", validity, cert)
+		}
+		if validity == 0 {
+			if cert.ValidAfter != 0 || cert.ValidBefore != ssh.CertTimeInfinity {
+				t.Errorf("expected a certificate without expiry, got %d-%d", cert.ValidAfter, cert.ValidBefore)
+			}
+		} else if validAfter, validBefore := int64(cert.ValidAfter), int64(cert.ValidBefore); validAfter >
+			before.Unix() || validAfter < before.Add(-10*time.Minute).Unix() ||
+			validBefore < before.Add(validity).Unix() || validBefore > time.Now().Add(validity).Unix() {
+			t.Errorf("expected a certificate valid for %v from now, got %d-%d", validity, validAfter, validBefore)
+		}
+
+		for _, principal := range principals {
+			if err := checker.CheckHostKey(principal+":22", address, cert); err != nil {
+				t.Errorf("%v: expected the certificate to be accepted for %s: %v", validity, principal, err)
+			}
+		}
+		if err := checker.CheckHostKey("other.example.com:22", address, cert); err == nil {
+			t.Errorf("%v: expected the certificate to be refused for another host", validity)
+		}
+	}
+
+	// a certificate that has expired, or is from another authority, is refused
+	cert, err := SignHostCertificate(authority, hostKey.PublicKey(), "nosshtradamus", principals, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker.Clock = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if err := checker.CheckHostKey("proxy:22", address, cert); err == nil {
+		t.Error("expected an expired certificate to be refused")
+	}
+	checker.Clock = nil
+	otherAuthority, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = SignHostCertificate(otherAuthority, hostKey.PublicKey(), "nosshtradamus", principals, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.CheckHostKey("proxy:22", address, cert); err == nil {
+		t.Error("expected a certificate from another authority to be refused")
+	}
+}
+
+func TestHostCertificateFiles(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "ssh_host_ecdsa_key"), filepath.Join(dir, "ssh_host_ed25519_key")}
+	generated, err := HostKeyFiles(paths, true)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a certificate beside a key is presented before it
+	authority, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := SignHostCertificate(authority, generated[1].PublicKey(), "proxy", []string{"proxy.example.com"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(paths[1]+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+	certified, err := HostKeyFiles(paths[1:], false)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certified) != 2 || !bytes.Equal(certified[0].PublicKey().Marshal(), cert.Marshal()) ||
+		!bytes.Equal(certified[1].PublicKey().Marshal(), generated[1].PublicKey().Marshal()) {
+		t.Error("expected the host certificate, followed by the plain key")
+	}
+	// a certificate for another key, or for users, is refused
+	userCert := *cert
+	userCert.CertType = ssh.UserCert
+	if err := userCert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := SignHostCertificate(authority, generated[0].PublicKey(), "proxy", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, badCert := range []*ssh.Certificate{&userCert, otherCert} {
+		if err := os.WriteFile(paths[1]+"-cert.pub", ssh.MarshalAuthorizedKey(badCert), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := HostKeyFiles(paths[1:], false)(); err == nil {
+			t.Error("expected an unusable host certificate to be refused")
+		}
+	}
+
+}
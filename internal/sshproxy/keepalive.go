@@ -0,0 +1,65 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"time"
+)
+
+const keepAliveRequest = "keepalive@openssh.com"
+
+// keepAlive probes the peer of an SSH connection with keepalive@openssh.com requests every interval, as the OpenSSH
+// client's ServerAliveInterval (and server's ClientAliveInterval) do. Any reply, even a failure, shows the peer is
+// alive. Once countMax probes in a row go unanswered, dead is called and probing stops; it also stops when done is
+// closed. As with OpenSSH's ServerAliveCountMax, a countMax of 0 gives up on the first probe left unanswered.
+func keepAlive(conn ssh.Conn, interval time.Duration, countMax int, done <-chan interface{}, dead func()) {
+	if countMax < 1 {
+		countMax = 1
+	}
+	answered := make(chan interface{}, 1)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	unanswered := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-answered:
+			unanswered = 0
+		case <-ticker.C:
+			if unanswered >= countMax {
+				dead()
+				return
+			}
+			unanswered++
+			// a probe of a dead peer blocks until the connection is closed
+			go func() {
+				if _, _, err := conn.SendRequest(keepAliveRequest, true, nil); err == nil {
+					select {
+					case answered <- true:
+					default:
+					}
+				}
+			}()
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// probedConn is an SSH connection counting the keepalive probes sent to it, which either answers them (with a failure,
+// as a peer not knowing the request does) or never does, like a peer behind a dead TCP connection.
+type probedConn struct {
+	ssh.Conn
+	answer bool
+	closed chan interface{}
+
+	mutex  sync.Mutex
+	probes int
+}
+
+func (pc *probedConn) SendRequest(name string, wantReply bool, _ []byte) (bool, []byte, error) {
+	pc.mutex.Lock()
+	if name == keepAliveRequest && wantReply {
+		pc.probes++
+	}
+	pc.mutex.Unlock()
+	if pc.answer {
+		return false, nil, nil
+	}
+	<-pc.closed
+	return false, nil, errors.New("connection closed")
+}
+
+func (pc *probedConn) probed() int {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return pc.probes
+}
+
+func TestKeepAlive(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	for _, test := range []struct {
+		name     string
+		countMax int
+		answer   bool
+		probes   int // sent before giving up, if not answered
+	}{
+		{"dead peer, count 0", 0, false, 1},
+		{"dead peer, count 1", 1, false, 1},
+		{"dead peer, count 3", 3, false, 3},
+		{"live peer", 0, true, 0},
+		{"live peer, count 3", 3, true, 0},
+	} {
+		conn := &probedConn{answer: test.answer, closed: make(chan interface{})}
+		done, dead := make(chan interface{}), make(chan interface{})
+		started := time.Now()
+		go keepAlive(conn, interval, test.countMax, done, func() { close(dead) })
+
+		select {
+		case <-dead:
+			elapsed := time.Since(started)
+			if test.answer {
+				t.Errorf("%s: expected a peer answering probes not to be given up on", test.name)
+			} else if elapsed < time.Duration(test.probes)*interval {
+				t.Errorf("%s: gave up after %v, before %d probes could go unanswered", test.name, elapsed, test.probes)
+			}
+		case <-time.After(time.Duration(test.probes+10) * interval):
+			if !test.answer {
+				t.Errorf("%s: expected the peer to be given up on", test.name)
+			}
+		}
+		close(done)
+		close(conn.closed)
+		if probes := conn.probed(); !test.answer && probes != test.probes {
+			t.Errorf("%s: expected %d probes before giving up, got %d", test.name, test.probes, probes)
+		} else if test.answer && probes < 3 {
+			t.Errorf("%s: expected the peer to be probed every interval, got %d probes", test.name, probes)
+		}
+	}
+
+	// probing stops once done, without the peer being given up on
+	conn := &probedConn{closed: make(chan interface{})}
+	defer close(conn.closed)
+	done, dead := make(chan interface{}), make(chan interface{})
+	go keepAlive(conn, interval, 0, done, func() { close(dead) })
+	close(done)
+	select {
+	case <-dead:
+		t.Error("expected a finished session's peer not to be given up on")
+	case <-time.After(5 * interval):
+	}
+}
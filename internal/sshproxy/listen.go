@@ -0,0 +1,99 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Listen opens a listener on a TCP address ("host:port", "[ipv6]:port"), or on a Unix domain socket ("unix:/path", or
+// any absolute path) created with the specified permissions. A stale socket left behind at the path is replaced.
+func Listen(address string, socketMode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") && !strings.HasPrefix(address, "/") {
+		return net.Listen("tcp", address)
+	}
+	socketPath := strings.TrimPrefix(address, "unix:")
+
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		// only remove the socket if nothing is listening on it anymore
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is already in use", socketPath)
+		}
+		_ = os.Remove(socketPath)
+	}
+
+	// restrict the permissions from creation, so there is no window in which the socket is more widely accessible
+	oldMask := syscall.Umask(0777 &^ int(socketMode.Perm()))
+	listener, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, socketMode.Perm()); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// SystemdListeners returns the sockets passed to this process by systemd socket activation (LISTEN_FDS), if any. The
+// activation environment variables are cleared, so that they are not inherited by child processes.
+func SystemdListeners() ([]net.Listener, error) {
+	return systemdListeners(3) // SD_LISTEN_FDS_START
+}
+
+// systemdListeners returns the sockets passed by socket activation, numbered from the first file descriptor.
+func systemdListeners(firstFd int) ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := firstFd; fd < firstFd+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-fd-%d", fd))
+		listener, err := net.FileListener(file)
+		_ = file.Close() // FileListener holds its own duplicate
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,169 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+	for _, address := range []string{socketPath, "unix:" + socketPath} {
+		for _, mode := range []os.FileMode{0600, 0660, 0666} {
+			listener, err := Listen(address, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(socketPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != mode {
+				t.Errorf("%s: expected a socket with mode %v, got %v", address, mode, info.Mode())
+			}
+
+			// a socket still being listened on is left alone
+			if _, err := Listen(address, mode); err == nil || !strings.Contains(err.Error(), "already in use") {
+				t.Errorf("%s: expected a socket in use to be refused, got %v", address, err)
+			}
+			if conn, err := net.Dial("unix", socketPath); err != nil {
+				t.Errorf("%s: expected the socket to still be listened on: %v", address, err)
+			} else {
+				_ = conn.Close()
+			}
+			_ = listener.Close()
+		}
+	}
+
+	// a socket left behind by a process that is gone is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+	if _, err := os.Lstat(socketPath); err != nil {
+		t.Fatalf("expected a stale socket to be left behind: %v", err)
+	}
+	listener, err := Listen(socketPath, 0600)
+	if err != nil {
+		t.Fatalf("expected a stale socket to be replaced: %v", err)
+	}
+	_ = listener.Close()
+
+	// anything else at the path is never removed
+	regularPath := filepath.Join(t.TempDir(), "regular")
+	if err := os.WriteFile(regularPath, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(regularPath, 0600); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("expected a regular file to be refused, got %v", err)
+	}
+	if content, err := os.ReadFile(regularPath); err != nil || string(content) != "keep" {
+		t.Errorf("expected the regular file to be kept (%v)", err)
+	}
+}
+
+// setActivationEnv sets the socket activation environment for the test, leaving variables given as "" unset.
+func setActivationEnv(t *testing.T, pid, fds string) {
+	for name, value := range map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": fds} {
+		previous, set := os.LookupEnv(name)
+		t.Cleanup(func() {
+			if set {
+				_ = os.Setenv(name, previous)
+			} else {
+				_ = os.Unsetenv(name)
+			}
+		})
+		if value == "" {
+			_ = os.Unsetenv(name)
+		} else {
+			_ = os.Setenv(name, value)
+		}
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	const unusedFd = 1 << 20 // never opened, so any attempt to use it fails
+	pid := strconv.Itoa(os.Getpid())
+	for _, test := range []struct {
+		name, pid, fds string
+	}{
+		{"not activated", "", ""},
+		{"no LISTEN_PID", "", "1"},
+		{"no LISTEN_FDS", pid, ""},
+		{"another process", strconv.Itoa(os.Getpid() + 1), "1"},
+		{"invalid LISTEN_PID", "systemd", "1"},
+		{"invalid LISTEN_FDS", pid, "many"},
+		{"no sockets", pid, "0"},
+	} {
+		setActivationEnv(t, test.pid, test.fds)
+		if listeners, err := systemdListeners(unusedFd); err != nil || listeners != nil {
+			t.Errorf("%s: expected no listeners, got %v (%v)", test.name, listeners, err)
+		}
+	}
+
+	// a socket passed by activation is listened on, and the environment is cleared for child processes
+	activated, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = activated.Close() }()
+	rawConn, err := activated.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := -1
+	if err := rawConn.Control(func(listenerFd uintptr) { fd, err = syscall.Dup(int(listenerFd)) }); err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	setActivationEnv(t, pid, "1")
+	listeners, err := systemdListeners(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("expected one listener, got %d", len(listeners))
+	}
+	defer func() { _ = listeners[0].Close() }()
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS"} {
+		if _, set := os.LookupEnv(name); set {
+			t.Errorf("expected %s to be cleared", name)
+		}
+	}
+	go func() {
+		if conn, err := net.Dial("tcp", activated.Addr().String()); err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatalf("expected a connection to the activated socket: %v", err)
+	}
+	_ = conn.Close()
+}
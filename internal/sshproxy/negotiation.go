@@ -0,0 +1,262 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Algorithms are those negotiated by the first key exchange of a connection.
+type Algorithms struct {
+	KeyExchange        string
+	HostKey            string
+	CipherClientServer string
+	CipherServerClient string
+	MACClientServer    string // empty for ciphers with integrated authentication (e.g. AES-GCM)
+	MACServerClient    string
+}
+
+func (a *Algorithms) String() string {
+	direction := func(clientServer, serverClient string) string {
+		if clientServer == serverClient {
+			return clientServer
+		}
+		return clientServer + "/" + serverClient
+	}
+	mac := direction(a.MACClientServer, a.MACServerClient)
+	if mac == "" {
+		mac = "implicit"
+	}
+	return fmt.Sprintf("kex %s, host key %s, cipher %s, MAC %s", a.KeyExchange, a.HostKey,
+		direction(a.CipherClientServer, a.CipherServerClient), mac)
+}
+
+// serverUnsupportedKex are key exchange algorithms the SSH library only implements for clients.
+var serverUnsupportedKex = map[string]bool{
+	"diffie-hellman-group-exchange-sha1":   true,
+	"diffie-hellman-group-exchange-sha256": true,
+}
+
+// checkServerKeyExchanges verifies that the key exchange algorithms can be offered to downstream clients.
+func checkServerKeyExchanges(kexAlgorithms []string) error {
+	for _, kex := range kexAlgorithms {
+		if serverUnsupportedKex[kex] {
+			return fmt.Errorf("sshproxy: key exchange %s is not supported for downstream clients", kex)
+		}
+	}
+	return nil
+}
+
+// rsaAlgorithms are the signature algorithms of RSA keys and certificates (the only key types with several).
+var rsaAlgorithms = map[string][]string{
+	ssh.KeyAlgoRSA:     {ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+	ssh.CertAlgoRSAv01: {ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01},
+}
+
+// restrictHostKeys limits the host keys to the algorithms permitted, omitting keys that cannot be used with any of
+// them, and restricting the signature algorithms of RSA keys.
+func restrictHostKeys(hostKeys []ssh.Signer, algorithms []string) ([]ssh.Signer, error) {
+	var restricted []ssh.Signer
+	for _, hostKey := range hostKeys {
+		keyType := hostKey.PublicKey().Type()
+		candidates, isRSA := rsaAlgorithms[keyType]
+		if !isRSA {
+			if findCommon([]string{keyType}, algorithms) != "" {
+				restricted = append(restricted, hostKey)
+			}
+			continue
+		}
+		// the library takes the plain signature algorithms, also for certificates
+		var permitted []string
+		for idx, candidate := range candidates {
+			if findCommon([]string{candidate}, algorithms) != "" {
+				permitted = append(permitted, rsaAlgorithms[ssh.KeyAlgoRSA][idx])
+			}
+		}
+		if len(permitted) == 0 {
+			continue
+		}
+		algorithmSigner, ok := hostKey.(ssh.AlgorithmSigner)
+		if !ok || len(permitted) == len(candidates) {
+			restricted = append(restricted, hostKey)
+			continue
+		}
+		multiSigner, err := ssh.NewSignerWithAlgorithms(algorithmSigner, permitted)
+		if err != nil {
+			return nil, err
+		}
+		restricted = append(restricted, multiSigner)
+	}
+	if len(restricted) == 0 {
+		return nil, errors.New("sshproxy: no host keys usable with the permitted host key algorithms")
+	}
+	return restricted, nil
+}
+
+// kexInitMsg is SSH_MSG_KEXINIT (RFC 4253, section 7.1).
+type kexInitMsg struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+const maxKexInitSize = 64 * 1024
+
+// kexSniffer observes the first SSH_MSG_KEXINIT sent in each direction of a connection. The SSH library doesn't report
+// the algorithms it negotiated, so they are worked out from these messages, which precede any encryption.
+type kexSniffer struct {
+	net.Conn
+	isClient bool
+
+	mutex    sync.Mutex
+	sent     kexInitReader
+	received kexInitReader
+}
+
+func newKexSniffer(conn net.Conn, isClient bool) *kexSniffer {
+	return &kexSniffer{Conn: conn, isClient: isClient}
+}
+
+func (ks *kexSniffer) Read(b []byte) (int, error) {
+	n, err := ks.Conn.Read(b)
+	if n > 0 {
+		ks.mutex.Lock()
+		ks.received.observe(b[:n])
+		ks.mutex.Unlock()
+	}
+	return n, err
+}
+
+func (ks *kexSniffer) Write(b []byte) (int, error) {
+	ks.mutex.Lock()
+	ks.sent.observe(b)
+	ks.mutex.Unlock()
+	return ks.Conn.Write(b)
+}
+
+// algorithms works out the negotiated algorithms (as the SSH library does), once both sides' messages were seen.
+func (ks *kexSniffer) algorithms() *Algorithms {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	client, server := ks.received.msg, ks.sent.msg
+	if ks.isClient {
+		client, server = server, client
+	}
+	if client == nil || server == nil {
+		return nil
+	}
+	algorithms := &Algorithms{
+		KeyExchange:        findCommon(client.KexAlgos, server.KexAlgos),
+		HostKey:            findCommon(client.ServerHostKeyAlgos, server.ServerHostKeyAlgos),
+		CipherClientServer: findCommon(client.CiphersClientServer, server.CiphersClientServer),
+		CipherServerClient: findCommon(client.CiphersServerClient, server.CiphersServerClient),
+	}
+	if !aeadCiphers[algorithms.CipherClientServer] {
+		algorithms.MACClientServer = findCommon(client.MACsClientServer, server.MACsClientServer)
+	}
+	if !aeadCiphers[algorithms.CipherServerClient] {
+		algorithms.MACServerClient = findCommon(client.MACsServerClient, server.MACsServerClient)
+	}
+	return algorithms
+}
+
+var aeadCiphers = map[string]bool{
+	"aes128-gcm@openssh.com":        true,
+	"aes256-gcm@openssh.com":        true,
+	"chacha20-poly1305@openssh.com": true,
+}
+
+// findCommon chooses the first of the client's algorithms that the server supports.
+func findCommon(client, server []string) string {
+	for _, algorithm := range client {
+		for _, supported := range server {
+			if algorithm == supported {
+				return algorithm
+			}
+		}
+	}
+	return ""
+}
+
+// kexInitReader parses one direction of a connection up to its first SSH_MSG_KEXINIT: the identification string
+// (possibly preceded by other lines, from servers), then the first binary packet.
+type kexInitReader struct {
+	buffer      []byte
+	versionSeen bool
+	done        bool
+	msg         *kexInitMsg
+}
+
+func (kr *kexInitReader) observe(data []byte) {
+	if kr.done {
+		return
+	}
+	kr.buffer = append(kr.buffer, data...)
+	for !kr.versionSeen {
+		end := bytes.IndexByte(kr.buffer, '\n')
+		if end < 0 {
+			if len(kr.buffer) > maxKexInitSize {
+				kr.finish(nil)
+			}
+			return
+		}
+		kr.versionSeen = bytes.HasPrefix(kr.buffer, []byte("SSH-"))
+		kr.buffer = kr.buffer[end+1:]
+	}
+	if len(kr.buffer) < 5 {
+		return
+	}
+	length := binary.BigEndian.Uint32(kr.buffer)
+	padding := uint32(kr.buffer[4])
+	if length > maxKexInitSize || padding+1 > length {
+		kr.finish(nil)
+		return
+	}
+	if uint32(len(kr.buffer)) < 4+length {
+		return
+	}
+	msg := &kexInitMsg{}
+	if err := ssh.Unmarshal(kr.buffer[5:4+length-padding], msg); err != nil {
+		msg = nil
+	}
+	kr.finish(msg)
+}
+
+func (kr *kexInitReader) finish(msg *kexInitMsg) {
+	kr.msg = msg
+	kr.done = true
+	kr.buffer = nil
+}
@@ -0,0 +1,306 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn captures what is written to a connection.
+type recordingConn struct {
+	net.Conn
+
+	mutex   sync.Mutex
+	written bytes.Buffer
+}
+
+func (rc *recordingConn) Write(b []byte) (int, error) {
+	rc.mutex.Lock()
+	rc.written.Write(b)
+	rc.mutex.Unlock()
+	return rc.Conn.Write(b)
+}
+
+func (rc *recordingConn) captured() []byte {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return append([]byte{}, rc.written.Bytes()...)
+}
+
+// replayConn reads back captured data a few bytes at a time, discarding whatever is written to it.
+type replayConn struct {
+	net.Conn
+	data  []byte
+	chunk int
+}
+
+func (rc *replayConn) Read(b []byte) (int, error) {
+	if len(rc.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b[:minInt(len(b), rc.chunk)], rc.data)
+	rc.data = rc.data[n:]
+	return n, nil
+}
+
+func (rc *replayConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// connPair connects two ends of a loopback TCP connection (which, unlike net.Pipe, both sides of an SSH connection can
+// write to at once).
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSide := <-accepted
+	if serverSide == nil {
+		t.Fatal("expected a connection")
+	}
+	t.Cleanup(func() {
+		_ = clientSide.Close()
+		_ = serverSide.Close()
+	})
+	_ = clientSide.SetDeadline(time.Now().Add(10 * time.Second))
+	_ = serverSide.SetDeadline(time.Now().Add(10 * time.Second))
+	return clientSide, serverSide
+}
+
+// handshakeCapturing runs a handshake between a client and a server with the configurations, returning the algorithms
+// the server's kexSniffer worked out, and the bytes each side sent.
+func handshakeCapturing(t *testing.T, clientConfig *ssh.ClientConfig,
+	serverConfig *ssh.ServerConfig) (*Algorithms, []byte, []byte) {
+	clientSide, serverSide := connPair(t)
+	clientRecorder, serverRecorder := &recordingConn{Conn: clientSide}, &recordingConn{Conn: serverSide}
+	sniffer := newKexSniffer(serverRecorder, false)
+	handshaken := make(chan error, 1)
+	go func() {
+		serverConn, _, _, err := ssh.NewServerConn(sniffer, serverConfig)
+		if err == nil {
+			_ = serverConn.Close()
+		}
+		handshaken <- err
+	}()
+	clientConn, _, _, err := ssh.NewClientConn(clientRecorder, "target:22", clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = clientConn.Close()
+	if err := <-handshaken; err != nil {
+		t.Fatal(err)
+	}
+	return sniffer.algorithms(), clientRecorder.captured(), serverRecorder.captured()
+}
+
+func TestKexSniffer(t *testing.T) {
+	hostKey, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true, Config: ssh.Config{
+		Ciphers: []string{"aes128-ctr", "aes256-ctr", "chacha20-poly1305@openssh.com"},
+		MACs:    []string{"hmac-sha2-256", "hmac-sha2-512"},
+	}}
+	serverConfig.AddHostKey(hostKey)
+	clientConfig := &ssh.ClientConfig{
+		User:            "tester",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Config: ssh.Config{
+			KeyExchanges: []string{"curve25519-sha256", "ecdh-sha2-nistp256"},
+			Ciphers:      []string{"aes256-ctr", "aes128-ctr"},
+			MACs:         []string{"hmac-sha2-512", "hmac-sha2-256"},
+		},
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+	}
+	expected := &Algorithms{
+		KeyExchange:        "curve25519-sha256",
+		HostKey:            ssh.KeyAlgoED25519,
+		CipherClientServer: "aes256-ctr",
+		CipherServerClient: "aes256-ctr",
+		MACClientServer:    "hmac-sha2-512",
+		MACServerClient:    "hmac-sha2-512",
+	}
+	negotiated, clientSent, serverSent := handshakeCapturing(t, clientConfig, serverConfig)
+	if !reflect.DeepEqual(negotiated, expected) {
+		t.Fatalf("expected %v, got %v", expected, negotiated)
+	}
+
+	// the same KEXINIT packets, arriving a few bytes at a time (and the server's sent in pieces), are parsed alike;
+	// from the client's side of the connection, the roles are reversed
+	for _, chunk := range []int{1, 3, 7, 1500} {
+		server := newKexSniffer(&replayConn{data: clientSent, chunk: chunk}, false)
+		client := newKexSniffer(&replayConn{data: serverSent, chunk: chunk}, true)
+		for pending := serverSent; len(pending) > 0; pending = pending[minInt(len(pending), chunk):] {
+			_, _ = server.Write(pending[:minInt(len(pending), chunk)])
+		}
+		_, _ = client.Write(clientSent)
+		buffer := make([]byte, 256)
+		for {
+			_, serverErr := server.Read(buffer)
+			_, clientErr := client.Read(buffer)
+			if serverErr != nil && clientErr != nil {
+				break
+			}
+		}
+		for side, sniffer := range map[string]*kexSniffer{"server": server, "client": client} {
+			if algorithms := sniffer.algorithms(); !reflect.DeepEqual(algorithms, expected) {
+				t.Errorf("%d byte reads, %s side: expected %v, got %v", chunk, side, expected, algorithms)
+			}
+		}
+	}
+
+	// an AEAD cipher has no separate MAC
+	clientConfig.Ciphers = []string{"chacha20-poly1305@openssh.com"}
+	if negotiated, _, _ = handshakeCapturing(t, clientConfig, serverConfig); negotiated.CipherClientServer !=
+		"chacha20-poly1305@openssh.com" || negotiated.MACClientServer != "" || negotiated.MACServerClient != "" {
+		t.Errorf("expected chacha20-poly1305 without a MAC, got %v", negotiated)
+	}
+}
+
+func TestKexSnifferMalformed(t *testing.T) {
+	packet := func(length uint32, padding byte, payload []byte) []byte {
+		header := make([]byte, 5)
+		binary.BigEndian.PutUint32(header, length)
+		header[4] = padding
+		return append(append([]byte("SSH-2.0-test\r\n"), header...), payload...)
+	}
+	kexInit := ssh.Marshal(&kexInitMsg{KexAlgos: []string{"curve25519-sha256"}})
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"oversized packet", packet(maxKexInitSize+1, 4, kexInit)},
+		{"padding beyond the packet", packet(8, 8, kexInit)},
+		{"not a KEXINIT", packet(uint32(1+len(kexInit)+4), 4, append([]byte{21}, kexInit[1:]...))},
+		{"no identification", bytes.Repeat([]byte("x"), maxKexInitSize+2)},
+	} {
+		var reader kexInitReader
+		reader.observe(append(test.data, make([]byte, 8)...))
+		if !reader.done || reader.msg != nil {
+			t.Errorf("%s: expected no KEXINIT (done %v, %v)", test.name, reader.done, reader.msg)
+		}
+	}
+
+	// lines before the identification string are skipped, as servers may send them
+	var reader kexInitReader
+	reader.observe([]byte("Welcome\r\n"))
+	reader.observe(packet(uint32(1+len(kexInit)+4), 4, append(kexInit, 0, 0, 0, 0)))
+	if reader.msg == nil || !reflect.DeepEqual(reader.msg.KexAlgos, []string{"curve25519-sha256"}) {
+		t.Errorf("expected the KEXINIT after a preceding line to be parsed, got %v", reader.msg)
+	}
+}
+
+func TestRestrictHostKeys(t *testing.T) {
+	edKey, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := ssh.NewSignerFromKey(rsaPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keys without any permitted algorithm are left out, and RSA keys are limited to the permitted signatures
+	restricted, err := restrictHostKeys([]ssh.Signer{edKey, rsaKey}, []string{ssh.KeyAlgoRSASHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restricted) != 1 {
+		t.Fatalf("expected only the RSA key to be kept, got %d keys", len(restricted))
+	}
+	restrictedRSA, ok := restricted[0].(ssh.MultiAlgorithmSigner)
+	if !ok || !reflect.DeepEqual(restrictedRSA.Algorithms(), []string{ssh.KeyAlgoRSASHA256}) {
+		t.Fatalf("expected the RSA key to be restricted to %s", ssh.KeyAlgoRSASHA256)
+	}
+	if !bytes.Equal(restrictedRSA.PublicKey().Marshal(), rsaKey.PublicKey().Marshal()) {
+		t.Fatal("expected the restricted key to be the same key")
+	}
+	if _, err := restrictHostKeys([]ssh.Signer{edKey}, []string{ssh.KeyAlgoRSASHA256}); err == nil {
+		t.Error("expected an error when no host key can be used")
+	}
+	if unrestricted, err := restrictHostKeys([]ssh.Signer{rsaKey}, rsaAlgorithms[ssh.KeyAlgoRSA]); err != nil ||
+		unrestricted[0] != rsaKey {
+		t.Error("expected a key usable with all its algorithms to be kept as it is")
+	}
+
+	// the restricted key changes what clients can negotiate: a client only accepting SHA-1 signatures is refused
+	for _, test := range []struct {
+		algorithm string
+		accepted  bool
+	}{
+		{ssh.KeyAlgoRSASHA256, true},
+		{ssh.KeyAlgoRSASHA512, false},
+		{ssh.KeyAlgoRSA, false},
+	} {
+		serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+		serverConfig.AddHostKey(restricted[0])
+		clientSide, serverSide := connPair(t)
+		go func() {
+			if serverConn, _, _, err := ssh.NewServerConn(serverSide, serverConfig); err == nil {
+				_ = serverConn.Close()
+			}
+			_ = serverSide.Close()
+		}()
+		clientConn, _, _, err := ssh.NewClientConn(clientSide, "target:22", &ssh.ClientConfig{
+			User:              "tester",
+			HostKeyCallback:   ssh.FixedHostKey(rsaKey.PublicKey()),
+			HostKeyAlgorithms: []string{test.algorithm},
+		})
+		if err == nil {
+			_ = clientConn.Close()
+		}
+		_ = clientSide.Close()
+		if test.accepted != (err == nil) {
+			t.Errorf("%s: expected acceptance %v, got %v", test.algorithm, test.accepted, err)
+		}
+	}
+}
@@ -22,23 +22,54 @@ import (
 	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
 
-	"fmt"
+	"context"
+	"errors"
 	"io"
+	"log"
 	"net"
+	"sync"
 	"time"
 )
 
 type ProxyConfig struct {
-	KeyProvider      HostKeyProvider
-	TargetKeyChecker ssh.HostKeyCallback
-	ChannelFilter    ChannelStreamFilter
-	AuthMethods      []ssh.AuthMethod
-	Banner           func(conn ssh.ConnMetadata) string
-	ReportAuthErr    bool
-	ExtraQuestions   chan *ProxiedAuthQuestion
-	BlockAgent       bool
+	KeyProvider         HostKeyProvider
+	TargetKeyChecker    TargetKeyCheckerProvider
+	TargetKeyAlgorithms TargetKeyAlgorithmsProvider // optional; defaults to the library's host key algorithms
+	ChannelFilter       ChannelStreamFilter
+	AuthMethods         AuthMethodsProvider
+	Banner              func(conn ssh.ConnMetadata) string
+	ReportAuthErr       bool
+	BlockAgent          bool
+	ClientAgentAuth     bool           // authenticate with the target after the client, to use its forwarded agent
+	BlockX11            bool           // refuse X11 forwarding requests from downstream clients
+	SpoofX11Cookie      bool           // send the target fake X11 cookies, restoring the real ones on X11 connections
+	TargetResolver      TargetResolver // chooses each session's target; defaults to the proxy's static target
+	UpstreamDialer      UpstreamDialer // connects to targets; defaults to DirectDialer
+	ConnectTimeout      time.Duration  // limit on connecting to the target (or first jump host); defaults to 3s
+	UpstreamConfig      ssh.Config     // algorithms and rekeying for connections to the target (and jump hosts)
+	DownstreamConfig    ssh.Config     // algorithms and rekeying for connections from downstream clients
+	HostKeyAlgorithms   []string       // host key algorithms offered to downstream clients; defaults to all of them
+	LogAlgorithms       bool           // log the algorithms negotiated with each downstream client and target
+	ShutdownMessage     string         // shown in interactive sessions still open when a shutdown deadline expires
+	Logger              *log.Logger    // optional destination for connection errors
+
+	ServerAliveInterval time.Duration // probe the target this often, closing the session if it stops answering
+	ServerAliveCountMax int           // unanswered target probes before giving up (0: the first)
+	ClientAliveInterval time.Duration // probe downstream clients this often, closing sessions that stop answering
+	ClientAliveCountMax int           // unanswered client probes before giving up (0: the first)
+
+	ClientKeyChecker ClientKeyChecker // authenticates downstream clients' public keys to the proxy itself (optional)
+	RequireClientKey bool             // only allow clients accepted by the ClientKeyChecker to authenticate upstream
+
+	HandshakeTimeout   time.Duration // limit on key exchange, before authentication begins (0: unlimited)
+	AuthTimeout        time.Duration // limit on authentication, including relayed questions (0: unlimited)
+	MaxUnauthenticated int           // limit on concurrent connections yet to authenticate (0: unlimited)
+	AuthRatePerMinute  float64       // authentication attempts allowed per minute from one source IP (0: unlimited)
+	AuthRateBurst      int           // authentication attempts allowed in a burst from one source IP
 }
 
+// A ProxiedAuthQuestion is relayed to the downstream user as a keyboard-interactive challenge. A question without a
+// Prompt only displays its Message; OnAnswer (if set) is then called with an empty answer.
 type ProxiedAuthQuestion struct {
 	Message  string
 	Prompt   string
@@ -46,7 +77,31 @@ type ProxiedAuthQuestion struct {
 	OnAnswer func(string) bool
 }
 
-type HostKeyProvider func() (ssh.Signer, error)
+// A HostKeyProvider supplies the host keys the proxy presents to downstream clients (one per key type, at most).
+type HostKeyProvider func() ([]ssh.Signer, error)
+
+// A TargetKeyCheckerProvider produces the callback verifying the host keys of the target (and any jump hosts) for one
+// session. Checkers that need to consult the downstream user (e.g. about unknown host keys) should do so via the
+// session's Ask function.
+type TargetKeyCheckerProvider func(session *Session) ssh.HostKeyCallback
+
+// A TargetKeyAlgorithmsProvider chooses the host key algorithms offered to the target (or a jump host) at an address,
+// e.g. to prefer the types of keys already on file for it. A nil result uses the library defaults.
+type TargetKeyAlgorithmsProvider func(session *Session, address string) []string
+
+// FixedKeyChecker verifies target host keys with the same callback for every session.
+func FixedKeyChecker(callback ssh.HostKeyCallback) TargetKeyCheckerProvider {
+	return func(_ *Session) ssh.HostKeyCallback {
+		return callback
+	}
+}
+
+// An AuthMethodsProvider produces the methods used to authenticate with the target on behalf of one session. Methods
+// that need to consult the downstream user (e.g. passwords, passphrases) should do so via the session's Ask function.
+// Password and keyboard-interactive methods should fail with ErrHostKeyChanged once the session's HostKeyChanged.
+// It is called for each authentication (with the target, and each jump host); resources the methods only need while
+// authenticating can be handed to the session's CloseAfterAuth.
+type AuthMethodsProvider func(session *Session) []ssh.AuthMethod
 
 // GenHostKey creates a new SSH host key
 func GenHostKey() (ssh.Signer, error) {
@@ -67,13 +122,44 @@ func blankInteractive(_, _ string, questions []string, _ []bool) ([]string, erro
 }
 
 var (
-	defaultTimeout     = 3 * time.Second
-	DefaultAuthMethods = []ssh.AuthMethod{
-		ssh.Password(""),
-		ssh.KeyboardInteractive(blankInteractive),
-	}
+	defaultTimeout           = 3 * time.Second
+	defaultShutdownMessage   = "Nosshtradamus proxy is shutting down; closing session."
+	defaultTargetLostMessage = "Nosshtradamus proxy lost contact with the target; closing session."
 )
 
+// ErrProxyClosed is returned by Serve once the proxy has been shut down or closed.
+var ErrProxyClosed = errors.New("sshproxy: proxy closed")
+
+// ErrHostKeyChanged is returned by AuthMethods that would send a password or keyboard-interactive answers to a target
+// whose changed host key was accepted.
+var ErrHostKeyChanged = errors.New("password and keyboard-interactive authentication are disabled to avoid " +
+	"man-in-the-middle attacks (the host key changed)")
+
+// DefaultAuthMethods sends blank passwords and keyboard-interactive answers, without consulting the downstream user,
+// after trying the keys of the downstream client's forwarded agent (if any).
+func DefaultAuthMethods(session *Session) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if session != nil && session.ClientAgent() != nil {
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return session.ClientAgentSigners(), nil
+		}))
+	}
+	return append(methods,
+		ssh.PasswordCallback(func() (string, error) {
+			if session != nil && session.HostKeyChanged() {
+				return "", ErrHostKeyChanged
+			}
+			return "", nil
+		}),
+		ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			if session != nil && session.HostKeyChanged() {
+				return nil, ErrHostKeyChanged
+			}
+			return blankInteractive(user, instruction, questions, echos)
+		}),
+	)
+}
+
 // A ChannelStreamFilter optionally encapsulates/wraps an SSH channel of the specified channel type.
 type ChannelStreamFilter func(channelType string, c ssh.Channel) (io.ReadWriteCloser, ChannelRequestFilter)
 
@@ -83,123 +169,390 @@ type ChannelRequestSink func(recipient ssh.Channel, sender <-chan *ssh.Request)
 // A ChannelRequestFilter takes one request sink and outputs one that may watch, filter, transform those requests.
 type ChannelRequestFilter func(sink ChannelRequestSink) ChannelRequestSink
 
-func RunProxy(listener net.Listener, target net.Addr, configOpts *ProxyConfig) error {
-	keyProvider := configOpts.KeyProvider
-	auth := configOpts.AuthMethods
-	keyCallback := configOpts.TargetKeyChecker
-	filter := configOpts.ChannelFilter
-	reportAuthErr := configOpts.ReportAuthErr
-	banner := configOpts.Banner
-
-	var proxyConn *ssh.Client
-	config := &ssh.ServerConfig{
-		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata,
-			challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-			user := conn.User()
-			var connErr error
-			established := make(chan interface{})
-			go func() {
-				// connecting to the remote host only when the proxy has enough information to make the connection
-				proxyConn, connErr = ssh.Dial("tcp", target.String(), &ssh.ClientConfig{
-					User:            user,
-					Timeout:         defaultTimeout,
-					HostKeyCallback: keyCallback,
-					Auth:            auth,
-				})
-				close(established)
-			}()
+// A MessageRenderer is optionally implemented by the streams a ChannelStreamFilter produces, to render a notice for the
+// downstream user (e.g. when the proxy shuts down) consistently with whatever the stream has already emitted.
+type MessageRenderer interface {
+	RenderMessage(message string) []byte
+}
 
-			asked := false
-			if configOpts.ExtraQuestions != nil {
-			loop:
-				// ask any supplemental questions; one at a time, until the target connection is established (or killed)
-				for {
-					select {
-					case question := <-configOpts.ExtraQuestions:
-						asked = true
-						answers, err := challenge(user, question.Message, []string{question.Prompt}, []bool{question.Echo})
-						if err != nil {
-							return nil, err
-						}
-						if len(answers) != 1 {
-							return nil, fmt.Errorf("expected 1 answer, got %d", len(answers))
-						}
-						if !question.OnAnswer(answers[0]) {
-							return nil, fmt.Errorf("wrong answer to %s", question.Message)
-						}
-						if connErr != nil {
-							break loop
-						}
-					case <-established:
-						break loop
-					}
-				}
-			} else {
-				<-established
-			}
-			if !asked || (reportAuthErr && connErr != nil) {
-				msg := ""
-				if connErr != nil {
-					msg = connErr.Error()
-				}
-				_, _ = challenge(user, msg, []string{}, []bool{})
-			}
+// A Route proxies the connections accepted on a listener to a target of their own, presenting host keys of their own
+// (e.g. a DerivedHostKey for the target), so that clients of a proxy serving several targets, one per listener, can
+// tell them apart. Unset fields default to the proxy's configuration.
+type Route struct {
+	Listener       net.Listener
+	TargetResolver TargetResolver                     // chooses the target of each session accepted on the listener
+	KeyProvider    HostKeyProvider                    // the host keys presented to clients of the listener
+	Banner         func(conn ssh.ConnMetadata) string // the banner shown to clients of the listener
+
+	hostKeys []ssh.Signer
+}
 
-			return nil, connErr
-		},
-		MaxAuthTries:   1,
-		BannerCallback: banner,
+// A Proxy accepts SSH connections from downstream clients, and relays each of them to the target server in its own
+// session. A Proxy may serve several listeners at once.
+type Proxy struct {
+	config *ProxyConfig
+	route  *Route // the default route, for listeners served without routes of their own
+
+	mutex     sync.Mutex
+	closing   bool
+	listeners map[net.Listener]struct{}
+	sessions  map[*Session]struct{}
+	active    sync.WaitGroup
+
+	unauthenticated chan interface{} // semaphore of connections yet to authenticate; nil if unlimited
+	authLimiter     *attemptLimiter
+}
+
+// NewProxy prepares a proxy to the target, using the host keys from the configuration's KeyProvider. If the
+// configuration has a TargetResolver, it chooses the target of each session instead (and target may be nil).
+func NewProxy(target net.Addr, config *ProxyConfig) (*Proxy, error) {
+	resolver := config.TargetResolver
+	if resolver == nil {
+		if target == nil {
+			return nil, errors.New("sshproxy: no target or target resolver specified")
+		}
+		resolver = StaticTarget(target)
 	}
-	hostKey, err := keyProvider()
+	hostKeys, err := loadHostKeys(config.KeyProvider, config.HostKeyAlgorithms)
 	if err != nil {
+		return nil, err
+	}
+	if err := checkServerKeyExchanges(config.DownstreamConfig.KeyExchanges); err != nil {
+		return nil, err
+	}
+	var unauthenticated chan interface{}
+	if config.MaxUnauthenticated > 0 {
+		unauthenticated = make(chan interface{}, config.MaxUnauthenticated)
+	}
+	return &Proxy{
+		config:          config,
+		route:           &Route{TargetResolver: resolver, Banner: config.Banner, hostKeys: hostKeys},
+		listeners:       map[net.Listener]struct{}{},
+		sessions:        map[*Session]struct{}{},
+		unauthenticated: unauthenticated,
+		authLimiter:     newAttemptLimiter(config.AuthRatePerMinute, config.AuthRateBurst),
+	}, nil
+}
+
+// loadHostKeys loads the host keys of the provider, restricted to the host key algorithms (if any).
+func loadHostKeys(provider HostKeyProvider, algorithms []string) ([]ssh.Signer, error) {
+	hostKeys, err := provider()
+	if err != nil {
+		return nil, err
+	}
+	if algorithms != nil {
+		return restrictHostKeys(hostKeys, algorithms)
+	}
+	return hostKeys, nil
+}
+
+// RunProxy serves connections from the listeners to the target until a listener fails.
+func RunProxy(listeners []net.Listener, target net.Addr, configOpts *ProxyConfig) error {
+	proxy, err := NewProxy(target, configOpts)
+	if err != nil {
+		return err
+	}
+	return proxy.ServeAll(context.Background(), listeners)
+}
+
+// Serve accepts connections on the listener, until the context is cancelled, the listener fails, or the proxy is shut
+// down. The listener is closed when Serve returns. Sessions accepted by Serve outlive it, until they finish on their
+// own or the proxy is shut down.
+func (p *Proxy) Serve(ctx context.Context, listener net.Listener) error {
+	return p.ServeRoute(ctx, &Route{Listener: listener})
+}
+
+// ServeRoute accepts connections on the route's listener, as Serve does, proxying them as the route directs. The
+// route's host keys are loaded before the first connection is accepted.
+func (p *Proxy) ServeRoute(ctx context.Context, route *Route) error {
+	listener := route.Listener
+	route, err := p.completeRoute(route)
+	if err != nil {
+		_ = listener.Close()
 		return err
 	}
-	config.AddHostKey(hostKey)
+	if !p.trackListener(listener, true) {
+		_ = listener.Close()
+		return ErrProxyClosed
+	}
+	defer p.trackListener(listener, false)
+	defer func() { _ = listener.Close() }()
 
+	stopped := make(chan interface{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = listener.Close() // unblocks Accept
+		case <-stopped:
+		}
+	}()
+
+	var backoff time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			continue
+			if p.isClosing() {
+				return ErrProxyClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if temporary, ok := err.(interface{ Temporary() bool }); ok && temporary.Temporary() {
+				// e.g. out of file descriptors; back off and try again, like net/http does
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				p.logf("accept error: %v; retrying in %v", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
 		}
+		backoff = 0
 
-		sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
-		if err != nil {
+		if p.authLimiter.exhausted(conn.RemoteAddr()) {
+			p.logf("rejecting %v: too many authentication attempts", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		if !p.acquireUnauthenticated() {
+			p.logf("rejecting %v: too many unauthenticated connections", conn.RemoteAddr())
+			_ = conn.Close()
 			continue
 		}
-		go func(proxyConn *ssh.Client, sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
-			// reflect connection level requests from the client; can the server initiate such requests, or just reply?
-			go reflectGlobalRequests(proxyConn, reqs)
 
-			// capture target server initiated channels; due to limitations of Go Crypto's SSH client, this is concrete,
-			// specifying a closed set of supported channels. specifically supporting SSH agent forwarding. alterations
-			// to the upstream library are possible if full proxying symmetry is desired (add wildcard handler callback)
-			go func() {
-				nc := proxyConn.HandleChannelOpen("auth-agent@openssh.com")
-				for channelRequest := range nc {
-					if configOpts.BlockAgent {
-						_ = channelRequest.Reject(ssh.Prohibited, "agent forwarding prohibited")
-						continue
-					}
-					go handleSshChannel(sshConn, proxyConn, channelRequest, nil)
-				}
-			}()
+		// each connection gets its own session, owning its upstream client and authentication question queue
+		session := newSession(p, conn)
+		session.route = route
+		if !p.trackSession(session, true) {
+			p.releaseUnauthenticated()
+			_ = conn.Close()
+			return ErrProxyClosed
+		}
+		// handshake off the accept loop, so that a stalled client can't hold up anyone else
+		go func() {
+			_ = p.runSession(session)
+		}()
+	}
+}
+
+// ServeConn serves a single, already established downstream connection (e.g. stdin/stdout, when run as an OpenSSH
+// ProxyCommand), returning once its session ends.
+func (p *Proxy) ServeConn(conn net.Conn) error {
+	if !p.acquireUnauthenticated() {
+		_ = conn.Close()
+		return errors.New("sshproxy: too many unauthenticated connections")
+	}
+	session := newSession(p, conn)
+	if !p.trackSession(session, true) {
+		p.releaseUnauthenticated()
+		_ = conn.Close()
+		return ErrProxyClosed
+	}
+	return p.runSession(session)
+}
+
+// runSession handshakes with a tracked session's downstream client, and relays its channels until it disconnects.
+func (p *Proxy) runSession(session *Session) error {
+	defer p.trackSession(session, false)
+	sshConn, chans, reqs, err := session.handshake(session.route.hostKeys)
+	p.releaseUnauthenticated()
+	if err != nil {
+		p.logf("handshake with %v failed: %v", session.conn.RemoteAddr(), err)
+		session.abandon()
+		_ = session.conn.Close()
+		return err
+	}
+	if p.config.LogAlgorithms && session.downstreamAlgorithms != nil {
+		p.logf("%v: client negotiated %v", session.conn.RemoteAddr(), session.downstreamAlgorithms)
+	}
+	if session.upstreamClient() == nil {
+		// authentication with the target was deferred until the client's agent could be reached
+		if err := session.connectWithClientAgent(sshConn); err != nil {
+			p.logf("%v: %v", session.conn.RemoteAddr(), err)
+			session.refuse(sshConn, chans, reqs, err)
+			return err
+		}
+	}
+	session.relay(sshConn, chans, reqs)
+	return nil
+}
+
+// ServeAll serves connections from each of the listeners concurrently, as Serve does. If any listener fails, the others
+// are closed as well; the first failure is returned.
+func (p *Proxy) ServeAll(ctx context.Context, listeners []net.Listener) error {
+	routes := make([]*Route, len(listeners))
+	for idx, listener := range listeners {
+		routes[idx] = &Route{Listener: listener}
+	}
+	return p.ServeRoutes(ctx, routes)
+}
+
+// ServeRoutes serves each of the routes concurrently, as ServeRoute does. If any route's listener fails, the others are
+// closed as well; the first failure is returned.
+func (p *Proxy) ServeRoutes(ctx context.Context, routes []*Route) error {
+	if len(routes) == 0 {
+		return errors.New("sshproxy: no listeners")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(routes))
+	for _, route := range routes {
+		go func(route *Route) {
+			errs <- p.ServeRoute(ctx, route)
+		}(route)
+	}
+	var first error
+	for range routes {
+		if err := <-errs; first == nil {
+			first = err
+			cancel()
+		}
+	}
+	return first
+}
+
+// Shutdown stops accepting new connections, and waits for open sessions to finish. If the context expires first, the
+// remaining sessions are closed (showing the configured shutdown message in interactive sessions), and the context's
+// error is returned.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.closeListeners()
+
+	drained := make(chan interface{})
+	go func() {
+		p.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		p.closeSessions()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+// Close immediately stops accepting new connections and closes all open sessions.
+func (p *Proxy) Close() error {
+	p.closeListeners()
+	p.closeSessions()
+	p.active.Wait()
+	return nil
+}
 
-			handleSshClientChannels(proxyConn, sshConn, chans, filter)
+func (p *Proxy) closeListeners() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closing = true
+	for listener := range p.listeners {
+		_ = listener.Close()
+	}
+}
+
+func (p *Proxy) closeSessions() {
+	message := p.config.ShutdownMessage
+	if message == "" {
+		message = defaultShutdownMessage
+	}
+	p.mutex.Lock()
+	var sessions []*Session
+	for session := range p.sessions {
+		sessions = append(sessions, session)
+	}
+	p.mutex.Unlock()
+	for _, session := range sessions {
+		_ = session.Close(message)
+	}
+}
+
+// completeRoute fills in a copy of the route with the proxy's defaults, and loads its host keys.
+func (p *Proxy) completeRoute(route *Route) (*Route, error) {
+	completed := *route
+	if completed.TargetResolver == nil {
+		completed.TargetResolver = p.route.TargetResolver
+	}
+	if completed.Banner == nil {
+		completed.Banner = p.route.Banner
+	}
+	if completed.KeyProvider == nil {
+		completed.hostKeys = p.route.hostKeys
+		return &completed, nil
+	}
+	hostKeys, err := loadHostKeys(completed.KeyProvider, p.config.HostKeyAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	completed.hostKeys = hostKeys
+	return &completed, nil
+}
+
+func (p *Proxy) isClosing() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.closing
+}
 
-			_ = proxyConn.Close()
-		}(proxyConn, sshConn, chans, reqs)
+func (p *Proxy) trackListener(listener net.Listener, add bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if add {
+		if p.closing {
+			return false
+		}
+		p.listeners[listener] = struct{}{}
+	} else {
+		delete(p.listeners, listener)
 	}
+	return true
 }
 
-func handleSshClientChannels(proxyConn *ssh.Client, client *ssh.ServerConn, nc <-chan ssh.NewChannel,
-	filter ChannelStreamFilter) {
-	for channelRequest := range nc {
-		go handleSshChannel(proxyConn, client, channelRequest, filter)
+func (p *Proxy) trackSession(session *Session, add bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if add {
+		if p.closing {
+			return false
+		}
+		p.sessions[session] = struct{}{}
+		p.active.Add(1)
+	} else {
+		delete(p.sessions, session)
+		p.active.Done()
 	}
+	return true
 }
 
-func handleSshChannel(clientSide ssh.Conn, _ ssh.Conn, request ssh.NewChannel,
-	filter ChannelStreamFilter) {
+func (p *Proxy) acquireUnauthenticated() bool {
+	if p.unauthenticated == nil {
+		return true
+	}
+	select {
+	case p.unauthenticated <- true:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Proxy) releaseUnauthenticated() {
+	if p.unauthenticated != nil {
+		<-p.unauthenticated
+	}
+}
+
+func (p *Proxy) logf(format string, v ...interface{}) {
+	if p.config.Logger != nil {
+		p.config.Logger.Printf(format, v...)
+	}
+}
+
+func (s *Session) handleSshChannel(clientSide ssh.Conn, request ssh.NewChannel, filter ChannelStreamFilter) {
 
 	chanType := request.ChannelType()
 	proxyChan, proxyReqs, err := clientSide.OpenChannel(chanType, request.ExtraData())
@@ -209,6 +562,7 @@ func handleSshChannel(clientSide ssh.Conn, _ ssh.Conn, request ssh.NewChannel,
 		} else {
 			_ = request.Reject(ssh.ConnectionFailed, err.Error())
 		}
+		return
 	}
 
 	clientChan, clientReqs, err := request.Accept()
@@ -229,6 +583,18 @@ func handleSshChannel(clientSide ssh.Conn, _ ssh.Conn, request ssh.NewChannel,
 		copyTarget = proxyChan
 	}
 	var clientRequestSink ChannelRequestSink = reflectRequests
+	if chanType == "session" {
+		clientRequestSink = s.filterX11Requests(clientRequestSink)
+
+		// interactive sessions are notified if the proxy closes them
+		s.trackChannel(clientChan, copyTarget, true)
+		defer func() {
+			go func() {
+				<-serverClosed
+				s.trackChannel(clientChan, copyTarget, false)
+			}()
+		}()
+	}
 	if requestFilter != nil {
 		clientRequestSink = requestFilter(clientRequestSink)
 	}
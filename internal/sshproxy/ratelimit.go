@@ -0,0 +1,125 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// attemptLimiter keeps a token bucket per source IP address, limiting how frequently clients from that address may
+// attempt to authenticate. Each attempt takes a token; tokens are replenished at a steady rate up to the burst size.
+type attemptLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	now   func() time.Time // the clock, replaceable in tests
+
+	mutex   sync.Mutex
+	buckets map[string]*attemptBucket
+}
+
+type attemptBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// number of tracked addresses above which fully replenished buckets are discarded
+const attemptLimiterPruneSize = 1024
+
+// newAttemptLimiter creates a limiter allowing perMinute attempts per source address, with bursts of up to burst
+// attempts. A nil limiter (allowing everything) is returned if perMinute is not positive.
+func newAttemptLimiter(perMinute float64, burst int) *attemptLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &attemptLimiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: map[string]*attemptBucket{},
+	}
+}
+
+func limiterKey(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case nil:
+		return ""
+	default:
+		return addr.String()
+	}
+}
+
+// refill brings the address' bucket up to date, creating it if necessary. Must be called with the mutex held.
+func (al *attemptLimiter) refill(key string, now time.Time) *attemptBucket {
+	bucket, ok := al.buckets[key]
+	if !ok {
+		if len(al.buckets) >= attemptLimiterPruneSize {
+			al.prune(now)
+		}
+		bucket = &attemptBucket{tokens: al.burst, updated: now}
+		al.buckets[key] = bucket
+		return bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * al.rate
+	if bucket.tokens > al.burst {
+		bucket.tokens = al.burst
+	}
+	bucket.updated = now
+	return bucket
+}
+
+// prune discards buckets that would have been fully replenished; they are indistinguishable from new ones.
+func (al *attemptLimiter) prune(now time.Time) {
+	for key, bucket := range al.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*al.rate >= al.burst {
+			delete(al.buckets, key)
+		}
+	}
+}
+
+// allow takes a token for an authentication attempt from the address, reporting if one was available.
+func (al *attemptLimiter) allow(addr net.Addr) bool {
+	if al == nil {
+		return true
+	}
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	bucket := al.refill(limiterKey(addr), al.now())
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// exhausted reports whether the address has no authentication attempts available, without taking any.
+func (al *attemptLimiter) exhausted(addr net.Addr) bool {
+	if al == nil {
+		return false
+	}
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	return al.refill(limiterKey(addr), al.now()).tokens < 1
+}
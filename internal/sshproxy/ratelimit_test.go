@@ -0,0 +1,251 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for an attemptLimiter, advanced by the test.
+type fakeClock struct {
+	time time.Time
+}
+
+func (fc *fakeClock) now() time.Time {
+	return fc.time
+}
+
+func (fc *fakeClock) advance(duration time.Duration) {
+	fc.time = fc.time.Add(duration)
+}
+
+func newTestLimiter(perMinute float64, burst int) (*attemptLimiter, *fakeClock) {
+	limiter := newAttemptLimiter(perMinute, burst)
+	clock := &fakeClock{time: time.Unix(1700000000, 0)}
+	limiter.now = clock.now
+	return limiter, clock
+}
+
+func sourceAddr(host string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: 50000}
+}
+
+func TestAttemptLimiterBurst(t *testing.T) {
+	limiter, _ := newTestLimiter(6, 3)
+	client, other := sourceAddr("192.0.2.1"), sourceAddr("192.0.2.2")
+	for attempt := 1; attempt <= 3; attempt++ {
+		if !limiter.allow(client) {
+			t.Fatalf("expected attempt %d of a burst of 3 to be allowed", attempt)
+		}
+	}
+	if !limiter.exhausted(client) || limiter.allow(client) {
+		t.Fatal("expected the fourth attempt to be refused")
+	}
+	// addresses are limited separately, regardless of the source port
+	if !limiter.allow(other) {
+		t.Error("expected another address to be allowed")
+	}
+	if limiter.allow(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50001}) {
+		t.Error("expected the limit to apply to every port of the address")
+	}
+
+	// a burst below 1 still allows one attempt
+	limiter, _ = newTestLimiter(6, 0)
+	if !limiter.allow(client) || limiter.allow(client) {
+		t.Error("expected a burst of 1")
+	}
+	// without a rate, there is no limit
+	if limiter := newAttemptLimiter(0, 3); limiter != nil || !limiter.allow(client) || limiter.exhausted(client) {
+		t.Error("expected no limit without a rate")
+	}
+}
+
+func TestAttemptLimiterRefill(t *testing.T) {
+	limiter, clock := newTestLimiter(6, 2) // one attempt every 10 seconds
+	client := sourceAddr("2001:db8::1")
+	limiter.allow(client)
+	limiter.allow(client)
+	if limiter.allow(client) {
+		t.Fatal("expected the burst to be used up")
+	}
+
+	clock.advance(9 * time.Second)
+	if !limiter.exhausted(client) {
+		t.Fatal("expected no attempt to be available before the refill interval")
+	}
+	clock.advance(time.Second)
+	if !limiter.allow(client) || limiter.allow(client) {
+		t.Fatal("expected exactly one attempt to be available after the refill interval")
+	}
+
+	// refilling stops at the burst size
+	clock.advance(time.Hour)
+	for attempt := 1; attempt <= 2; attempt++ {
+		if !limiter.allow(client) {
+			t.Fatalf("expected attempt %d after a long pause to be allowed", attempt)
+		}
+	}
+	if limiter.allow(client) {
+		t.Fatal("expected refilling to stop at the burst size")
+	}
+}
+
+func TestAttemptLimiterPrune(t *testing.T) {
+	limiter, clock := newTestLimiter(60, 1) // one attempt a second
+	for idx := 0; idx < attemptLimiterPruneSize; idx++ {
+		limiter.allow(sourceAddr("10.0." + strconv.Itoa(idx/256) + "." + strconv.Itoa(idx%256)))
+	}
+	if len(limiter.buckets) != attemptLimiterPruneSize {
+		t.Fatalf("expected %d tracked addresses, got %d", attemptLimiterPruneSize, len(limiter.buckets))
+	}
+
+	// a new address prunes the buckets that have been refilled since, but not those still limited
+	clock.advance(time.Second)
+	limited := sourceAddr("192.0.2.1")
+	limiter.allow(limited)
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("expected refilled buckets to be pruned, %d left", len(limiter.buckets))
+	}
+	for idx := 0; idx < attemptLimiterPruneSize; idx++ {
+		limiter.allow(sourceAddr("10.1." + strconv.Itoa(idx/256) + "." + strconv.Itoa(idx%256)))
+	}
+	clock.advance(time.Second / 2)
+	limiter.allow(sourceAddr("192.0.2.2"))
+	if !limiter.exhausted(limited) {
+		t.Error("expected a limited address to remain limited after pruning")
+	}
+	if len(limiter.buckets) != attemptLimiterPruneSize+2 {
+		t.Errorf("expected no buckets to be pruned before they are refilled, %d left", len(limiter.buckets))
+	}
+}
+
+// serveProxy starts a proxy to the target with the configuration, returning its listen address.
+func serveProxy(t *testing.T, target net.Addr, config *ProxyConfig) string {
+	config.KeyProvider = EphemeralHostKey
+	config.TargetKeyChecker = FixedKeyChecker(ssh.InsecureIgnoreHostKey())
+	proxy, err := NewProxy(target, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = proxy.Serve(context.Background(), listener) }()
+	t.Cleanup(func() { _ = proxy.Close() })
+	return listener.Addr().String()
+}
+
+// expectDisconnected expects the proxy to close the connection within the time limit.
+func expectDisconnected(t *testing.T, conn net.Conn, within time.Duration, description string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(within))
+	buffer := make([]byte, 256)
+	for {
+		if _, err := conn.Read(buffer); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatalf("expected %s", description)
+			}
+			return
+		}
+	}
+}
+
+func dialClient(address string, challenge ssh.KeyboardInteractiveChallenge) error {
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "tester",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth:            []ssh.AuthMethod{ssh.KeyboardInteractive(challenge)},
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		_ = client.Close()
+	}
+	return err
+}
+
+func TestMaxUnauthenticated(t *testing.T) {
+	target := runTarget(t, make(chan interface{}, 10), make(chan interface{}, 10))
+	address := serveProxy(t, target, &ProxyConfig{MaxUnauthenticated: 1})
+
+	// a client yet to start its handshake holds the only slot
+	idle, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = idle.Close() }()
+	if _, err := idle.Read(make([]byte, 256)); err != nil { // the proxy's version string, once it is being served
+		t.Fatal(err)
+	}
+	refused, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDisconnected(t, refused, 5*time.Second, "a connection beyond the limit to be refused")
+
+	// once it leaves, the slot is free again (as soon as the proxy notices)
+	_ = idle.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for err := dialClient(address, blankInteractive); err != nil; err = dialClient(address, blankInteractive) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a client to be served once the slot is free: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// and an authenticated client releases it too
+	if err := dialClient(address, blankInteractive); err != nil {
+		t.Fatalf("expected another client to be served: %v", err)
+	}
+}
+
+func TestHandshakeAndAuthTimeouts(t *testing.T) {
+	target := runTarget(t, make(chan interface{}, 10), make(chan interface{}, 10))
+	address := serveProxy(t, target, &ProxyConfig{
+		HandshakeTimeout: 200 * time.Millisecond,
+		AuthTimeout:      200 * time.Millisecond,
+	})
+
+	// a client that never starts its handshake is disconnected once the handshake timeout expires
+	idle, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = idle.Close() }()
+	expectDisconnected(t, idle, 5*time.Second, "a client without a handshake to be disconnected")
+
+	// a client that is slow to authenticate is disconnected once the authentication timeout expires
+	slowAnswer := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		time.Sleep(time.Second)
+		return blankInteractive(user, instruction, questions, echos)
+	}
+	if err := dialClient(address, slowAnswer); err == nil {
+		t.Error("expected a client slow to authenticate to be disconnected")
+	}
+
+	// whereas one authenticating in time is not
+	if err := dialClient(address, blankInteractive); err != nil {
+		t.Errorf("expected a prompt client to authenticate: %v", err)
+	}
+}
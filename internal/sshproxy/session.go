@@ -0,0 +1,631 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Session is the proxy's state for one downstream client connection. It owns the upstream client connection made on
+// behalf of that client, the queue of supplemental authentication questions relayed to that client, and the handlers
+// for channels opened by either side. Nothing in a session is shared with any other connection.
+type Session struct {
+	proxy  *Proxy
+	config *ProxyConfig
+	route  *Route
+	conn   net.Conn
+
+	user       string // guarded by mutex, as are target and upstream
+	remoteAddr net.Addr
+	target     *Target
+	clientKey  ssh.PublicKey // the key the downstream client authenticated to the proxy itself with, if any
+
+	questions    chan *ProxiedAuthQuestion
+	authBegan    sync.Once
+	authDone     chan interface{}
+	authDoneOnce sync.Once
+	lost         chan interface{} // closed once the downstream client is gone, or the session abandoned
+	lostOnce     sync.Once
+
+	upstream   *ssh.Client
+	downstream *ssh.ServerConn
+
+	upstreamAlgorithms   *Algorithms
+	downstreamAlgorithms *Algorithms
+	clientAgent          agent.Agent // the downstream client's forwarded agent, while authenticating with it
+	authResources        []io.Closer // used by AuthMethods until the authentication in progress is over
+
+	mutex          sync.Mutex
+	closed         bool
+	abandoned      bool                               // no upstream connection is to be kept
+	hostKeyChanged bool                               // a changed host key was accepted (see AcceptChangedHostKey)
+	channels       map[ssh.Channel]io.ReadWriteCloser // interactive channels to the downstream client, and their streams
+	x11Grants      []*x11Grant                        // X11 cookies substituted in requests to the target
+}
+
+var (
+	// ErrNotAuthenticating is returned when asking a question of a session that is no longer relaying authentication.
+	ErrNotAuthenticating = errors.New("session is not authenticating")
+
+	errTooManyAttempts = errors.New("too many authentication attempts")
+	errAbandoned       = errors.New("session abandoned")
+)
+
+type dialResult struct {
+	client     *ssh.Client
+	algorithms *Algorithms
+	err        error
+}
+
+func newSession(proxy *Proxy, conn net.Conn) *Session {
+	return &Session{
+		proxy:     proxy,
+		config:    proxy.config,
+		route:     proxy.route,
+		conn:      conn,
+		questions: make(chan *ProxiedAuthQuestion),
+		authDone:  make(chan interface{}),
+		lost:      make(chan interface{}),
+		channels:  map[ssh.Channel]io.ReadWriteCloser{},
+	}
+}
+
+// User is the username the downstream client authenticated with.
+func (s *Session) User() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.user
+}
+
+// Target is the upstream target the session was resolved to, once the downstream client has started authenticating.
+func (s *Session) Target() *Target {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.target
+}
+
+// RemoteAddr is the network address of the downstream client.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+// Verified reports whether the downstream client authenticated to the proxy itself, with a key accepted by the
+// configured ClientKeyChecker.
+func (s *Session) Verified() bool {
+	return s.clientKey != nil
+}
+
+// ClientKey is the public key (or certificate) the downstream client authenticated to the proxy with, if any.
+func (s *Session) ClientKey() ssh.PublicKey {
+	return s.clientKey
+}
+
+// UpstreamAlgorithms are the algorithms negotiated with the target, once the session has authenticated with it.
+func (s *Session) UpstreamAlgorithms() *Algorithms {
+	return s.upstreamAlgorithms
+}
+
+// DownstreamAlgorithms are the algorithms negotiated with the downstream client, once its handshake has completed.
+func (s *Session) DownstreamAlgorithms() *Algorithms {
+	return s.downstreamAlgorithms
+}
+
+// AcceptChangedHostKey is called by a TargetKeyChecker that accepts a host key other than the one on file for the
+// target (or a jump host). As the OpenSSH client does, the session then refuses agent, X11 and port forwarding, and
+// AuthMethods should no longer send passwords or keyboard-interactive answers (see HostKeyChanged).
+func (s *Session) AcceptChangedHostKey() {
+	s.mutex.Lock()
+	s.hostKeyChanged = true
+	s.mutex.Unlock()
+}
+
+// HostKeyChanged reports whether a changed host key was accepted for the session (see AcceptChangedHostKey).
+func (s *Session) HostKeyChanged() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.hostKeyChanged
+}
+
+// CloseAfterAuth registers a resource used by the session's AuthMethods (e.g. a connection to an agent), to be closed
+// once the authentication in progress with the target (or a jump host) is over.
+func (s *Session) CloseAfterAuth(resource io.Closer) {
+	s.mutex.Lock()
+	s.authResources = append(s.authResources, resource)
+	s.mutex.Unlock()
+}
+
+func (s *Session) closeAuthResources() {
+	s.mutex.Lock()
+	resources := s.authResources
+	s.authResources = nil
+	s.mutex.Unlock()
+	for _, resource := range resources {
+		_ = resource.Close()
+	}
+}
+
+// Ask relays a question to the downstream user via keyboard-interactive challenge, blocking until it has been sent.
+// Answers are delivered to the question's OnAnswer callback. Questions can only be asked while the session is
+// authenticating with the target; afterwards, ErrNotAuthenticating is returned.
+func (s *Session) Ask(question *ProxiedAuthQuestion) error {
+	select {
+	case s.questions <- question:
+		return nil
+	case <-s.authDone:
+		return ErrNotAuthenticating
+	}
+}
+
+func (s *Session) finishAuth() {
+	s.authDoneOnce.Do(func() {
+		close(s.authDone)
+	})
+}
+
+func (s *Session) lose() {
+	s.lostOnce.Do(func() {
+		close(s.lost)
+	})
+}
+
+// lossDetector notices the loss of the downstream connection while the session is busy elsewhere (e.g. connecting to
+// the target), from the failed read of the SSH library's reader.
+type lossDetector struct {
+	net.Conn
+	session *Session
+}
+
+func (ld *lossDetector) Read(b []byte) (int, error) {
+	n, err := ld.Conn.Read(b)
+	if err != nil {
+		ld.session.lose()
+	}
+	return n, err
+}
+
+// Close ends the session, disconnecting both the downstream client and the upstream target. The message is rendered
+// into each open interactive channel before it is closed.
+func (s *Session) Close(message string) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	channels := make(map[ssh.Channel]io.ReadWriteCloser, len(s.channels))
+	for channel, stream := range s.channels {
+		channels[channel] = stream
+	}
+	s.mutex.Unlock()
+
+	if message != "" {
+		for channel, stream := range channels {
+			var rendered []byte
+			if renderer, ok := stream.(MessageRenderer); ok {
+				rendered = renderer.RenderMessage(message)
+			} else {
+				rendered = []byte("\r\n" + message + "\r\n")
+			}
+			_, _ = channel.Write(rendered)
+			_ = channel.Close()
+		}
+	}
+	s.abandon()
+	return s.conn.Close()
+}
+
+func (s *Session) trackChannel(channel ssh.Channel, stream io.ReadWriteCloser, add bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if add {
+		s.channels[channel] = stream
+	} else {
+		delete(s.channels, channel)
+	}
+}
+
+// abandon releases the upstream resources of a session, e.g. when the downstream handshake did not complete.
+// Any upstream connection still being made is closed once it is established (see setUpstream).
+func (s *Session) abandon() {
+	s.finishAuth()
+	s.lose()
+	s.mutex.Lock()
+	s.abandoned = true
+	upstream := s.upstream
+	s.mutex.Unlock()
+	if upstream != nil {
+		_ = upstream.Close()
+	}
+}
+
+// handshake performs key exchange with, and authentication of, the downstream client. Key exchange must complete
+// within the handshake timeout, after which the client is given the authentication timeout to authenticate.
+func (s *Session) handshake(hostKeys []ssh.Signer) (*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request,
+	error) {
+	if s.config.HandshakeTimeout > 0 {
+		_ = s.conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	}
+	sniffer := newKexSniffer(&lossDetector{Conn: s.conn, session: s}, false)
+	sshConn, chans, reqs, err := ssh.NewServerConn(sniffer, s.serverConfig(hostKeys))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.downstreamAlgorithms = sniffer.algorithms()
+	_ = s.conn.SetDeadline(time.Time{})
+	return sshConn, chans, reqs, nil
+}
+
+// beginAuth switches from the handshake timeout to the authentication timeout, once the client starts authenticating.
+func (s *Session) beginAuth() {
+	s.authBegan.Do(func() {
+		if s.config.AuthTimeout > 0 {
+			_ = s.conn.SetDeadline(time.Now().Add(s.config.AuthTimeout))
+		} else {
+			_ = s.conn.SetDeadline(time.Time{})
+		}
+	})
+}
+
+func (s *Session) serverConfig(hostKeys []ssh.Signer) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		Config:                      s.config.DownstreamConfig,
+		KeyboardInteractiveCallback: s.keyboardInteractive,
+		MaxAuthTries:                1,
+		BannerCallback:              s.route.Banner,
+		AuthLogCallback: func(_ ssh.ConnMetadata, _ string, _ error) {
+			s.beginAuth() // the first attempt (usually method "none") marks the end of key exchange
+		},
+	}
+	if s.config.ClientKeyChecker != nil {
+		// clients commonly offer several keys before finding an acceptable one
+		config.MaxAuthTries = 6
+		config.PublicKeyCallback = s.publicKey
+		if s.config.RequireClientKey {
+			config.KeyboardInteractiveCallback = nil
+		}
+	}
+	for _, hostKey := range hostKeys {
+		config.AddHostKey(hostKey)
+	}
+	return config
+}
+
+// resolveTarget resolves the target of the session for an authentication attempt; the username may differ between
+// attempts.
+func (s *Session) resolveTarget(conn ssh.ConnMetadata) (*Target, error) {
+	s.mutex.Lock()
+	s.user = conn.User()
+	s.mutex.Unlock()
+	s.remoteAddr = conn.RemoteAddr()
+	target, err := s.route.TargetResolver(conn)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.target = target
+	s.mutex.Unlock()
+	return target, nil
+}
+
+// publicKey authenticates the downstream client to the proxy itself. An accepted key is only a partial success: the
+// client must then continue with keyboard-interactive authentication, which relays authentication with the target.
+func (s *Session) publicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	s.beginAuth()
+	target, err := s.resolveTarget(conn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.config.ClientKeyChecker(conn, target.User, key); err != nil {
+		s.proxy.authLimiter.allow(s.remoteAddr) // rejected keys count towards the rate limit
+		s.proxy.logf("%v: public key %s rejected for %s: %v", s.remoteAddr, ssh.FingerprintSHA256(key),
+			target.User, err)
+		return nil, err
+	}
+	return nil, &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata,
+				challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				s.clientKey = key
+				return s.keyboardInteractive(conn, challenge)
+			},
+		},
+	}
+}
+
+func (s *Session) keyboardInteractive(conn ssh.ConnMetadata,
+	challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	s.beginAuth()
+	defer s.finishAuth()
+	if !s.proxy.authLimiter.allow(conn.RemoteAddr()) {
+		return nil, errTooManyAttempts
+	}
+	target, err := s.resolveTarget(conn)
+	if err != nil {
+		_, _ = challenge(conn.User(), err.Error(), []string{}, []bool{})
+		return nil, err
+	}
+	if s.config.ClientAgentAuth {
+		return nil, nil // the target is connected to once the client's agent can be reached
+	}
+
+	dialed := make(chan dialResult, 1)
+	go func() {
+		// connecting to the remote host only when the proxy has enough information to make the connection
+		client, algorithms, err := s.dialUpstream(target)
+		dialed <- dialResult{client, algorithms, err}
+	}()
+	// if authentication is abandoned before the target connection resolves, don't leak the upstream client (which the
+	// loss of the downstream client cancels, see dialUpstream)
+	abandonDial := func() {
+		go func() {
+			if result := <-dialed; result.client != nil {
+				_ = result.client.Close()
+			}
+		}()
+	}
+
+	asked := false
+	var result dialResult
+loop:
+	// ask any supplemental questions; one at a time, until the target connection is established (or killed)
+	for {
+		select {
+		case question := <-s.questions:
+			asked = true
+			if question.Prompt == "" {
+				// informational only
+				if _, err := challenge(conn.User(), question.Message, []string{}, []bool{}); err != nil {
+					abandonDial()
+					return nil, err
+				}
+				if question.OnAnswer != nil {
+					question.OnAnswer("")
+				}
+				continue
+			}
+			answers, err := challenge(conn.User(), question.Message, []string{question.Prompt}, []bool{question.Echo})
+			if err != nil {
+				abandonDial()
+				return nil, err
+			}
+			if len(answers) != 1 {
+				abandonDial()
+				return nil, fmt.Errorf("expected 1 answer, got %d", len(answers))
+			}
+			if !question.OnAnswer(answers[0]) {
+				abandonDial()
+				return nil, fmt.Errorf("wrong answer to %s", question.Message)
+			}
+		case result = <-dialed:
+			break loop
+		case <-s.lost:
+			abandonDial()
+			return nil, errAbandoned
+		}
+	}
+	if !asked || (s.config.ReportAuthErr && result.err != nil) {
+		msg := ""
+		if result.err != nil {
+			msg = result.err.Error()
+		}
+		_, _ = challenge(conn.User(), msg, []string{}, []bool{})
+	}
+
+	if result.err != nil {
+		return nil, result.err
+	}
+	if err := s.setUpstream(result.client, result.algorithms); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// upstreamClient is the session's upstream connection, once authenticated with the target.
+func (s *Session) upstreamClient() *ssh.Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.upstream
+}
+
+// setUpstream keeps the client as the session's upstream connection, unless the session was abandoned while it was
+// being connected, in which case it is closed instead.
+func (s *Session) setUpstream(client *ssh.Client, algorithms *Algorithms) error {
+	s.mutex.Lock()
+	if s.abandoned {
+		s.mutex.Unlock()
+		_ = client.Close()
+		return errAbandoned
+	}
+	previous := s.upstream
+	s.upstream = client
+	target := s.target
+	s.mutex.Unlock()
+	if previous != nil {
+		// a repeated authentication attempt; only the most recent upstream connection is kept
+		_ = previous.Close()
+	}
+	s.upstreamAlgorithms = algorithms
+	if s.config.LogAlgorithms && algorithms != nil {
+		s.proxy.logf("%v: target %v negotiated %v", s.remoteAddr, target, algorithms)
+	}
+	return nil
+}
+
+// ClientConfig produces the configuration for authenticating as the user with the target (or a jump host on the way to
+// it) at the address, on behalf of this session.
+func (s *Session) ClientConfig(user, address string) *ssh.ClientConfig {
+	auth := s.config.AuthMethods
+	if auth == nil {
+		auth = DefaultAuthMethods
+	}
+	config := &ssh.ClientConfig{
+		Config:  s.config.UpstreamConfig,
+		User:    user,
+		Timeout: defaultTimeout,
+		Auth:    auth(s),
+	}
+	if s.config.TargetKeyChecker != nil {
+		config.HostKeyCallback = s.config.TargetKeyChecker(s)
+	}
+	if s.config.TargetKeyAlgorithms != nil {
+		config.HostKeyAlgorithms = s.config.TargetKeyAlgorithms(s, address)
+	}
+	return config
+}
+
+func (s *Session) dialUpstream(target *Target) (*ssh.Client, *Algorithms, error) {
+	dialer := s.config.UpstreamDialer
+	if dialer == nil {
+		dialer = DirectDialer
+	}
+	conn, err := dialer(s, "tcp", target.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+	// there is no one left to authenticate for once the downstream client is gone
+	connected := make(chan interface{})
+	defer close(connected)
+	go func() {
+		select {
+		case <-s.lost:
+			_ = conn.Close()
+		case <-connected:
+		}
+	}()
+	sniffer := newKexSniffer(conn, true)
+	clientConn, chans, reqs, err := ssh.NewClientConn(sniffer, target.Address,
+		s.ClientConfig(target.User, target.Address))
+	s.closeAuthResources()
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return ssh.NewClient(clientConn, chans, reqs), sniffer.algorithms(), nil
+}
+
+// relay proxies requests and channels between the downstream client and the upstream target until the downstream
+// client disconnects.
+func (s *Session) relay(downstream *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	s.downstream = downstream
+
+	// as with the OpenSSH client, a target whose changed host key was accepted is not trusted with any forwarding
+	restricted := s.HostKeyChanged()
+
+	// capture target server initiated channels; due to limitations of Go Crypto's SSH client, this is concrete,
+	// specifying a closed set of supported channels: SSH agent forwarding, and the channels resulting from remote port
+	// forwarding (tcpip-forward and streamlocal-forward requests reflected below). alterations to the upstream library
+	// are possible if full proxying symmetry is desired (add wildcard handler callback)
+	s.relayUpstreamChannels("auth-agent@openssh.com", s.config.BlockAgent || restricted, "agent forwarding prohibited",
+		nil)
+	s.relayUpstreamChannels("x11", s.config.BlockX11 || restricted, "X11 forwarding prohibited", s.x11Filter)
+	s.relayUpstreamChannels("forwarded-tcpip", restricted, "port forwarding prohibited", nil)
+	s.relayUpstreamChannels("forwarded-streamlocal@openssh.com", restricted, "port forwarding prohibited", nil)
+
+	// reflect connection level requests from the client; can the server initiate such requests, or just reply? only
+	// once all the handlers above are registered, so channels opened in response to a forwarding request aren't lost
+	if restricted {
+		reqs = refuseForwarding(reqs)
+	}
+	go reflectGlobalRequests(s.upstream, reqs)
+
+	// losing the target ends the session for the downstream client too
+	go func() {
+		_ = s.upstream.Wait()
+		_ = s.downstream.Close()
+	}()
+
+	// peers that stop answering (e.g. behind a half-dead TCP connection) are disconnected from, rather than leaving the
+	// session frozen; the downstream user is told when the target is lost
+	relayDone := make(chan interface{})
+	defer close(relayDone)
+	if s.config.ServerAliveInterval > 0 {
+		go keepAlive(s.upstream, s.config.ServerAliveInterval, s.config.ServerAliveCountMax, relayDone, func() {
+			s.proxy.logf("%v: target %v not responding; closing session", s.remoteAddr, s.Target())
+			_ = s.Close(defaultTargetLostMessage)
+		})
+	}
+	if s.config.ClientAliveInterval > 0 {
+		go keepAlive(s.downstream, s.config.ClientAliveInterval, s.config.ClientAliveCountMax, relayDone, func() {
+			s.proxy.logf("%v: client not responding; closing session", s.remoteAddr)
+			_ = s.Close("")
+		})
+	}
+
+	for channelRequest := range chans {
+		if restricted && forwardingChannels[channelRequest.ChannelType()] {
+			_ = channelRequest.Reject(ssh.Prohibited, "port forwarding prohibited")
+			continue
+		}
+		go s.handleSshChannel(s.upstream, channelRequest, s.config.ChannelFilter)
+	}
+
+	_ = s.upstream.Close()
+}
+
+// forwardingRequests and forwardingChannels are the global requests and channels of the downstream client for remote
+// and local port forwarding.
+var (
+	forwardingRequests = map[string]bool{"tcpip-forward": true, "streamlocal-forward@openssh.com": true}
+	forwardingChannels = map[string]bool{"direct-tcpip": true, "direct-streamlocal@openssh.com": true}
+)
+
+// refuseForwarding passes on global requests, except those for port forwarding, which are refused.
+func refuseForwarding(sender <-chan *ssh.Request) <-chan *ssh.Request {
+	passthrough := make(chan *ssh.Request)
+	go func() {
+		for request := range sender {
+			if forwardingRequests[request.Type] {
+				if request.WantReply {
+					_ = request.Reply(false, nil)
+				}
+				continue
+			}
+			passthrough <- request
+		}
+		close(passthrough)
+	}()
+	return passthrough
+}
+
+// relayUpstreamChannels relays channels of the type opened by the target server to the downstream client, unless
+// prohibited. Handling is registered before returning, so no channels opened afterwards are missed.
+func (s *Session) relayUpstreamChannels(channelType string, prohibited bool, reason string,
+	filter ChannelStreamFilter) {
+	nc := s.upstream.HandleChannelOpen(channelType)
+	if nc == nil {
+		return // already handled
+	}
+	go func() {
+		for channelRequest := range nc {
+			if prohibited {
+				_ = channelRequest.Reject(ssh.Prohibited, reason)
+				continue
+			}
+			go s.handleSshChannel(s.downstream, channelRequest, filter)
+		}
+	}()
+}
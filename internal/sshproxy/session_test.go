@@ -0,0 +1,209 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// runTarget runs an upstream SSH server accepting any client, reporting each connection on connected once accepted,
+// and on disconnected once it closes (or fails its handshake).
+func runTarget(t *testing.T, connected, disconnected chan<- interface{}) net.Addr {
+	hostKey, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connected <- nil
+			go func() {
+				defer func() { disconnected <- nil }()
+				serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					for nc := range chans {
+						_ = nc.Reject(ssh.Prohibited, "no channels")
+					}
+				}()
+				_ = serverConn.Wait()
+			}()
+		}
+	}()
+	return listener.Addr()
+}
+
+// expectSignal waits for a signal on the channel, failing with the description if it doesn't arrive.
+func expectSignal(t *testing.T, signal <-chan interface{}, description string) {
+	t.Helper()
+	select {
+	case <-signal:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s", description)
+	}
+}
+
+func TestShutdownDuringDial(t *testing.T) {
+	connected, disconnected := make(chan interface{}, 1), make(chan interface{}, 1)
+	target := runTarget(t, connected, disconnected)
+
+	// the proxy is shut down (with an expired deadline, closing the session) while connecting to the target, racing
+	// the session's abandonment against the upstream connection being kept; run with -race
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	shutdown := make(chan error, 1)
+	var proxy *Proxy
+	proxy, err := NewProxy(target, &ProxyConfig{
+		KeyProvider:      EphemeralHostKey,
+		TargetKeyChecker: FixedKeyChecker(ssh.InsecureIgnoreHostKey()),
+		UpstreamDialer: func(session *Session, network, address string) (net.Conn, error) {
+			go func() { shutdown <- proxy.Shutdown(ctx) }()
+			return DirectDialer(session, network, address)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = proxy.Serve(context.Background(), listener) }()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "tester",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth:            []ssh.AuthMethod{ssh.KeyboardInteractive(blankInteractive)},
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		_ = client.Wait() // disconnected by the shutdown
+	}
+
+	// whichever came first, the target connection must not outlive the session
+	expectSignal(t, connected, "the target connection")
+	expectSignal(t, disconnected, "the target connection to be closed")
+	select {
+	case <-shutdown:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the shutdown")
+	}
+}
+
+func TestSetUpstreamAfterAbandon(t *testing.T) {
+	connected, disconnected := make(chan interface{}, 1), make(chan interface{}, 1)
+	target := runTarget(t, connected, disconnected)
+	client, err := ssh.Dial("tcp", target.String(), &ssh.ClientConfig{
+		User:            "tester",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSignal(t, connected, "the target connection")
+
+	session := newSession(&Proxy{config: &ProxyConfig{}}, nil)
+	session.abandon()
+	if err := session.setUpstream(client, nil); err != errAbandoned {
+		t.Fatalf("expected an abandoned session to refuse the upstream connection, got %v", err)
+	}
+	if session.upstreamClient() != nil {
+		t.Fatal("expected an abandoned session to keep no upstream connection")
+	}
+	expectSignal(t, disconnected, "the refused upstream connection to be closed")
+}
+
+func TestClientLostDuringDial(t *testing.T) {
+	// a target that never completes its handshake, holding the proxy's connection until it is closed
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = silent.Close() }()
+	closed := make(chan interface{})
+	go func() {
+		conn, err := silent.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Read(make([]byte, 1<<16)) // the proxy's version string
+		for {
+			if _, err := conn.Read(make([]byte, 1<<16)); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	dialing := make(chan interface{})
+	proxy, err := NewProxy(silent.Addr(), &ProxyConfig{
+		KeyProvider:      EphemeralHostKey,
+		TargetKeyChecker: FixedKeyChecker(ssh.InsecureIgnoreHostKey()),
+		UpstreamDialer: func(session *Session, network, address string) (net.Conn, error) {
+			close(dialing)
+			return DirectDialer(session, network, address)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = proxy.Serve(context.Background(), listener) }()
+	defer func() { _ = proxy.Close() }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _, _, _ = ssh.NewClientConn(conn, listener.Addr().String(), &ssh.ClientConfig{
+			User:            "tester",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Auth:            []ssh.AuthMethod{ssh.KeyboardInteractive(blankInteractive)},
+		})
+	}()
+	expectSignal(t, dialing, "the proxy to connect to the target")
+
+	// the downstream client giving up cancels the connection to the target
+	_ = conn.Close()
+	expectSignal(t, closed, "the target connection to be closed")
+}
@@ -0,0 +1,83 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// stdioAddr is the (nominal) address of both ends of a stdio connection.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioConn is a net.Conn reading from one file and writing to another, e.g. the stdin and stdout of a ProxyCommand.
+type stdioConn struct {
+	in  *os.File
+	out *os.File
+}
+
+// StdioConn produces a connection that reads from in and writes to out; closing it closes both. Deadlines are applied
+// where the files support them (e.g. pipes), and otherwise ignored.
+func StdioConn(in, out *os.File) net.Conn {
+	return &stdioConn{in: in, out: out}
+}
+
+func (sc *stdioConn) Read(p []byte) (int, error) {
+	return sc.in.Read(p)
+}
+
+func (sc *stdioConn) Write(p []byte) (int, error) {
+	return sc.out.Write(p)
+}
+
+func (sc *stdioConn) Close() error {
+	inErr := sc.in.Close()
+	if err := sc.out.Close(); err != nil {
+		return err
+	}
+	return inErr
+}
+
+func (sc *stdioConn) LocalAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (sc *stdioConn) RemoteAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (sc *stdioConn) SetDeadline(t time.Time) error {
+	_ = sc.in.SetReadDeadline(t)
+	_ = sc.out.SetWriteDeadline(t)
+	return nil
+}
+
+func (sc *stdioConn) SetReadDeadline(t time.Time) error {
+	_ = sc.in.SetReadDeadline(t)
+	return nil
+}
+
+func (sc *stdioConn) SetWriteDeadline(t time.Time) error {
+	_ = sc.out.SetWriteDeadline(t)
+	return nil
+}
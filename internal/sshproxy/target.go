@@ -0,0 +1,126 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A Target is the upstream server a session connects to, and the user it authenticates as there.
+type Target struct {
+	User    string
+	Address string // host:port
+}
+
+func (t *Target) String() string {
+	return fmt.Sprintf("%s@%s", t.User, t.Address)
+}
+
+// A TargetResolver chooses the target for a downstream connection, e.g. based on the username it presented. It is
+// called once the downstream client starts authenticating.
+type TargetResolver func(conn ssh.ConnMetadata) (*Target, error)
+
+// StaticTarget resolves every connection to the same address, authenticating as the downstream user.
+func StaticTarget(address net.Addr) TargetResolver {
+	return StaticHostTarget(address.String())
+}
+
+// StaticHostTarget resolves every connection to the same "host:port" address, authenticating as the downstream user.
+// The host is kept as named rather than resolved, so that the target's host key is looked up under that name (and the
+// name is resolved anew for each connection).
+func StaticHostTarget(address string) TargetResolver {
+	return func(conn ssh.ConnMetadata) (*Target, error) {
+		return &Target{
+			User:    conn.User(),
+			Address: address,
+		}, nil
+	}
+}
+
+// UserEncodedTargets resolves targets encoded in downstream usernames, as "user%host[:port]" or "user+host[:port]".
+// Destinations must match one of the allowed patterns (see path.Match, where "*" also matches dots); patterns containing
+// a port match the port as well as the host, and others the host alone. IPv6 hosts with a port are written in brackets,
+// in usernames (e.g. "user%[2001:db8::1]:22") as well as patterns (e.g. "[2001:db8::*]:22").
+func UserEncodedTargets(allowed []string, defaultPort int) TargetResolver {
+	return func(conn ssh.ConnMetadata) (*Target, error) {
+		target, err := ParseUserEncodedTarget(conn.User(), defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		host, port, _ := net.SplitHostPort(target.Address)
+		if !targetAllowed(allowed, strings.ToLower(host), port) {
+			return nil, fmt.Errorf("destination %s is not permitted by this proxy", target.Address)
+		}
+		return target, nil
+	}
+}
+
+// ParseUserEncodedTarget splits a username of the form "user%host[:port]" or "user+host[:port]" into the upstream user
+// and destination address.
+func ParseUserEncodedTarget(username string, defaultPort int) (*Target, error) {
+	separator := strings.IndexAny(username, "%+")
+	if separator < 0 {
+		return nil, fmt.Errorf("username %q does not specify a destination (user%%host[:port] or user+host[:port])",
+			username)
+	}
+	user, destination := username[:separator], username[separator+1:]
+	if user == "" || destination == "" {
+		return nil, fmt.Errorf("username %q must specify both a user and a destination", username)
+	}
+
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		// no port specified (including bare IPv6 addresses)
+		host, port = strings.Trim(destination, "[]"), strconv.Itoa(defaultPort)
+	}
+	if host == "" {
+		return nil, fmt.Errorf("username %q does not specify a destination host", username)
+	}
+	if portNum, err := strconv.Atoi(port); err != nil || portNum < 1 || portNum > 65535 {
+		return nil, fmt.Errorf("invalid destination port %q", port)
+	}
+	return &Target{
+		User:    user,
+		Address: net.JoinHostPort(host, port),
+	}, nil
+}
+
+func targetAllowed(allowed []string, host, port string) bool {
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		// host and port are matched separately, so that the brackets of IPv6 hosts aren't taken for character classes
+		hostPattern, portPattern, err := net.SplitHostPort(pattern)
+		if err != nil {
+			hostPattern, portPattern = pattern, "*"
+		}
+		if matched, err := path.Match(hostPattern, host); err != nil || !matched {
+			continue
+		}
+		if matched, err := path.Match(portPattern, port); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
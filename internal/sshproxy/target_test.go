@@ -0,0 +1,94 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"testing"
+)
+
+func TestParseUserEncodedTarget(t *testing.T) {
+	for _, test := range []struct {
+		username string
+		target   *Target // nil if invalid
+	}{
+		{"alice%example.com", &Target{User: "alice", Address: "example.com:22"}},
+		{"alice+example.com", &Target{User: "alice", Address: "example.com:22"}},
+		{"alice%example.com:2222", &Target{User: "alice", Address: "example.com:2222"}},
+		{"alice+example.com:2222", &Target{User: "alice", Address: "example.com:2222"}},
+		{"alice%192.0.2.1:2222", &Target{User: "alice", Address: "192.0.2.1:2222"}},
+		{"alice%[::1]:2222", &Target{User: "alice", Address: "[::1]:2222"}},
+		{"alice%[::1]", &Target{User: "alice", Address: "[::1]:22"}},
+		{"alice%::1", &Target{User: "alice", Address: "[::1]:22"}},
+		{"alice%bob%example.com", &Target{User: "alice", Address: "bob%example.com:22"}}, // split at the first
+		{"alice", nil},
+		{"%example.com", nil},
+		{"alice%", nil},
+		{"alice+", nil},
+		{"alice%:22", nil},
+		{"alice%[]:22", nil},
+		{"alice%example.com:0", nil},
+		{"alice%example.com:65536", nil},
+		{"alice%example.com:ssh", nil},
+	} {
+		target, err := ParseUserEncodedTarget(test.username, 22)
+		switch {
+		case test.target == nil && err == nil:
+			t.Errorf("%q: expected an error, got %v", test.username, target)
+		case test.target != nil && err != nil:
+			t.Errorf("%q: expected %v, got %v", test.username, test.target, err)
+		case test.target != nil && *target != *test.target:
+			t.Errorf("%q: expected %v, got %v", test.username, test.target, target)
+		}
+	}
+}
+
+func TestTargetAllowed(t *testing.T) {
+	for _, test := range []struct {
+		allowed []string
+		host    string
+		port    string
+		matched bool
+	}{
+		{nil, "example.com", "22", false},
+		{[]string{"example.com"}, "example.com", "22", true},
+		{[]string{"example.com"}, "example.com", "2222", true}, // without a port, any port
+		{[]string{"EXAMPLE.com"}, "example.com", "22", true},
+		{[]string{"example.com:22"}, "example.com", "22", true},
+		{[]string{"example.com:22"}, "example.com", "2222", false},
+		{[]string{"example.com:*"}, "example.com", "2222", true},
+		{[]string{"*.example.com"}, "host.example.com", "22", true},
+		{[]string{"*.example.com"}, "a.b.example.com", "22", true}, // * matches dots too
+		{[]string{"*.example.com"}, "example.com", "22", false},
+		{[]string{"*.example.com:22"}, "host.example.com", "2222", false},
+		{[]string{"host?.example.com"}, "host1.example.com", "22", true},
+		{[]string{"192.0.2.*"}, "192.0.2.1", "22", true},
+		{[]string{"192.0.2.*:22"}, "192.0.2.1", "22", true},
+		{[]string{"[::1]:22"}, "::1", "22", true},
+		{[]string{"[::1]:22"}, "::1", "2222", false},
+		{[]string{"[2001:db8::*]:22"}, "2001:db8::1", "22", true},
+		{[]string{"::1"}, "::1", "2222", true},
+		{[]string{"other.example.com", "example.com"}, "example.com", "22", true},
+		{[]string{"["}, "example.com", "22", false}, // malformed patterns match nothing
+	} {
+		if matched := targetAllowed(test.allowed, test.host, test.port); matched != test.matched {
+			t.Errorf("expected %v to allow %s port %s: %v, was %v", test.allowed, test.host, test.port, test.matched,
+				matched)
+		}
+	}
+}
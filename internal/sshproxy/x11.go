@@ -0,0 +1,183 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// X11 forwarding: the client's "x11-req" carries the authentication cookie for its X server, which the remote server
+// hands to X clients. Much like the OpenSSH client itself does, the proxy can substitute a fake cookie upstream, and
+// restore the real one in the connection setup of each X11 channel the remote server opens, so the real cookie never
+// leaves the proxy.
+
+type x11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string // hex encoded
+	ScreenNumber     uint32
+}
+
+type x11Grant struct {
+	protocol string
+	fake     []byte
+	real     []byte
+}
+
+var errX11Cookie = errors.New("X11 connection rejected: unrecognized authentication")
+
+// filterX11Requests intercepts "x11-req" requests on a session channel, refusing them if X11 forwarding is prohibited,
+// or substituting fake authentication cookies if so configured.
+func (s *Session) filterX11Requests(sink ChannelRequestSink) ChannelRequestSink {
+	return func(recipient ssh.Channel, sender <-chan *ssh.Request) {
+		passthrough := make(chan *ssh.Request)
+		go sink(recipient, passthrough)
+		for request := range sender {
+			if request.Type == "x11-req" {
+				if s.config.BlockX11 || s.HostKeyChanged() {
+					if request.WantReply {
+						_ = request.Reply(false, nil)
+					}
+					continue
+				}
+				if s.config.SpoofX11Cookie {
+					if payload, err := s.spoofX11Cookie(request.Payload); err == nil {
+						request.Payload = payload
+					} else {
+						if request.WantReply {
+							_ = request.Reply(false, nil)
+						}
+						continue
+					}
+				}
+			}
+			passthrough <- request
+		}
+		close(passthrough)
+	}
+}
+
+// spoofX11Cookie records the real cookie of an x11-req payload, and returns the payload with a fake one in its place.
+func (s *Session) spoofX11Cookie(payload []byte) ([]byte, error) {
+	var request x11Request
+	if err := ssh.Unmarshal(payload, &request); err != nil {
+		return nil, err
+	}
+	real, err := hex.DecodeString(request.AuthCookie)
+	if err != nil {
+		return nil, err
+	}
+	fake := make([]byte, len(real))
+	if _, err := rand.Read(fake); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	s.x11Grants = append(s.x11Grants, &x11Grant{
+		protocol: request.AuthProtocol,
+		fake:     fake,
+		real:     real,
+	})
+	s.mutex.Unlock()
+
+	request.AuthCookie = hex.EncodeToString(fake)
+	return ssh.Marshal(&request), nil
+}
+
+// realX11Cookie finds the real cookie for a fake one handed out by this session.
+func (s *Session) realX11Cookie(protocol string, fake []byte) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, grant := range s.x11Grants {
+		if grant.protocol == protocol && subtle.ConstantTimeCompare(grant.fake, fake) == 1 {
+			return grant.real, true
+		}
+	}
+	return nil, false
+}
+
+// x11Filter wraps the downstream side of X11 channels opened by the remote server, restoring real cookies.
+func (s *Session) x11Filter(_ string, c ssh.Channel) (io.ReadWriteCloser, ChannelRequestFilter) {
+	if !s.config.SpoofX11Cookie {
+		return nil, nil
+	}
+	return &x11CookieRewriter{ReadWriteCloser: c, session: s}, nil
+}
+
+// x11CookieRewriter buffers the connection setup message an X client sends, replacing the fake cookie it presents with
+// the real one before passing it on (along with everything after it) to the downstream X server.
+type x11CookieRewriter struct {
+	io.ReadWriteCloser
+	session   *Session
+	setup     []byte
+	rewritten bool
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+func (xr *x11CookieRewriter) Write(p []byte) (int, error) {
+	if xr.rewritten {
+		return xr.ReadWriteCloser.Write(p)
+	}
+	xr.setup = append(xr.setup, p...)
+
+	// setup: byte-order, unused, major version (2), minor version (2), name length (2), data length (2), unused (2),
+	// followed by the authorization protocol name and data, each padded to a multiple of 4 bytes
+	if len(xr.setup) < 12 {
+		return len(p), nil
+	}
+	var order binary.ByteOrder
+	switch xr.setup[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return 0, errX11Cookie
+	}
+	nameLen := int(order.Uint16(xr.setup[6:8]))
+	dataLen := int(order.Uint16(xr.setup[8:10]))
+	if len(xr.setup) < 12+pad4(nameLen)+pad4(dataLen) {
+		return len(p), nil
+	}
+	name := string(xr.setup[12 : 12+nameLen])
+	data := xr.setup[12+pad4(nameLen) : 12+pad4(nameLen)+dataLen]
+	real, ok := xr.session.realX11Cookie(name, data)
+	if !ok || len(real) != len(data) {
+		return 0, errX11Cookie
+	}
+	copy(data, real)
+
+	xr.rewritten = true
+	setup := xr.setup
+	xr.setup = nil
+	if _, err := xr.ReadWriteCloser.Write(setup); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,272 @@
+/*
+ * nosshtradamus: predictive terminal emulation for SSH
+ * Copyright 2019-2023 Daniel Selifonov
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sshproxy
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const x11Protocol = "MIT-MAGIC-COOKIE-1"
+
+// x11Setup is the connection setup message of an X client (see x11CookieRewriter.Write), in the byte order.
+func x11Setup(order binary.ByteOrder, protocol string, cookie []byte) []byte {
+	setup := make([]byte, 12, 12+pad4(len(protocol))+pad4(len(cookie)))
+	if order == binary.BigEndian {
+		setup[0] = 'B'
+	} else {
+		setup[0] = 'l'
+	}
+	order.PutUint16(setup[2:4], 11)
+	order.PutUint16(setup[6:8], uint16(len(protocol)))
+	order.PutUint16(setup[8:10], uint16(len(cookie)))
+	setup = append(setup, protocol...)
+	setup = append(setup, make([]byte, pad4(len(protocol))-len(protocol))...)
+	setup = append(setup, cookie...)
+	return append(setup, make([]byte, pad4(len(cookie))-len(cookie))...)
+}
+
+func newCookie(t *testing.T) []byte {
+	cookie := make([]byte, 16)
+	if _, err := rand.Read(cookie); err != nil {
+		t.Fatal(err)
+	}
+	return cookie
+}
+
+// x11Payload is an x11-req payload for the cookie.
+func x11Payload(cookie []byte) []byte {
+	return ssh.Marshal(&x11Request{AuthProtocol: x11Protocol, AuthCookie: hex.EncodeToString(cookie)})
+}
+
+// bufferCloser is the downstream side of an X11 channel, collecting what is written to it.
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (bc *bufferCloser) Close() error {
+	return nil
+}
+
+func TestX11CookieRewriter(t *testing.T) {
+	session := newSession(&Proxy{config: &ProxyConfig{SpoofX11Cookie: true}}, nil)
+	real := newCookie(t)
+	payload, err := session.spoofX11Cookie(x11Payload(real))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request x11Request
+	if err := ssh.Unmarshal(payload, &request); err != nil {
+		t.Fatal(err)
+	}
+	fake, err := hex.DecodeString(request.AuthCookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.AuthProtocol != x11Protocol || len(fake) != len(real) || bytes.Equal(fake, real) {
+		t.Fatalf("expected a fake cookie of the same protocol and length, got %s %x", request.AuthProtocol, fake)
+	}
+
+	following := []byte("requests following the setup")
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		// the setup arrives in fragments, as X11 channel data may
+		stream := append(x11Setup(order, x11Protocol, fake), following...)
+		downstream := &bufferCloser{}
+		rewriter := &x11CookieRewriter{ReadWriteCloser: downstream, session: session}
+		for idx := 0; idx < len(stream); idx += 5 {
+			end := idx + 5
+			if end > len(stream) {
+				end = len(stream)
+			}
+			if n, err := rewriter.Write(stream[idx:end]); err != nil || n != end-idx {
+				t.Fatalf("%v: writing setup: %d, %v", order, n, err)
+			}
+		}
+		expected := append(x11Setup(order, x11Protocol, real), following...)
+		if !bytes.Equal(downstream.Bytes(), expected) {
+			t.Errorf("%v: expected the setup with the real cookie and what follows it, got %q", order,
+				downstream.Bytes())
+		}
+
+		// unrecognized cookies and protocols are refused, with nothing passed on
+		for _, setup := range [][]byte{
+			x11Setup(order, x11Protocol, newCookie(t)),
+			x11Setup(order, x11Protocol, real),
+			x11Setup(order, "XDM-AUTHORIZATION-1", fake),
+		} {
+			downstream := &bufferCloser{}
+			rewriter := &x11CookieRewriter{ReadWriteCloser: downstream, session: session}
+			if _, err := rewriter.Write(setup); err != errX11Cookie || downstream.Len() > 0 {
+				t.Errorf("%v: expected an unrecognized cookie to be refused, got %v, passing on %q", order, err,
+					downstream.Bytes())
+			}
+		}
+	}
+
+	setup := x11Setup(binary.BigEndian, x11Protocol, fake)
+	setup[0] = 'X'
+	rewriter := &x11CookieRewriter{ReadWriteCloser: &bufferCloser{}, session: session}
+	if _, err := rewriter.Write(setup); err != errX11Cookie {
+		t.Errorf("expected an invalid byte order to be refused, got %v", err)
+	}
+}
+
+type x11ChannelPayload struct {
+	OriginatorAddress string
+	OriginatorPort    uint32
+}
+
+// runX11Server runs an upstream SSH server accepting one connection, which reports the cookie of the first x11-req
+// request it receives, and then opens an X11 channel for each of the setup messages produced from that cookie.
+func runX11Server(t *testing.T, cookies chan<- []byte, setups ...func(cookie []byte) []byte) net.Addr {
+	hostKey, err := GenHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		defer func() { _ = serverConn.Close() }()
+		go ssh.DiscardRequests(reqs)
+		for nc := range chans {
+			if nc.ChannelType() != "session" {
+				_ = nc.Reject(ssh.Prohibited, "sessions only")
+				continue
+			}
+			channel, requests, err := nc.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = channel.Close() }()
+			for request := range requests {
+				var x11 x11Request
+				if request.Type != "x11-req" || ssh.Unmarshal(request.Payload, &x11) != nil {
+					_ = request.Reply(false, nil)
+					continue
+				}
+				_ = request.Reply(true, nil)
+				cookie, _ := hex.DecodeString(x11.AuthCookie)
+				cookies <- cookie
+				for _, setup := range setups {
+					x11Channel, x11Requests, err := serverConn.OpenChannel("x11",
+						ssh.Marshal(&x11ChannelPayload{"127.0.0.1", 6010}))
+					if err != nil {
+						return
+					}
+					go ssh.DiscardRequests(x11Requests)
+					_, _ = x11Channel.Write(setup(cookie))
+					_ = x11Channel.CloseWrite()
+				}
+			}
+		}
+	}()
+	return listener.Addr()
+}
+
+func TestX11CookieSpoofing(t *testing.T) {
+	real, wrong := newCookie(t), newCookie(t)
+	following := []byte("after the setup")
+	cookies := make(chan []byte, 1)
+	target := runX11Server(t, cookies,
+		func(cookie []byte) []byte {
+			return append(x11Setup(binary.LittleEndian, x11Protocol, cookie), following...)
+		},
+		func([]byte) []byte {
+			return x11Setup(binary.BigEndian, x11Protocol, wrong)
+		})
+	client, err := ssh.Dial("tcp", serveProxy(t, target, &ProxyConfig{SpoofX11Cookie: true}), &ssh.ClientConfig{
+		User:            "tester",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth:            []ssh.AuthMethod{ssh.KeyboardInteractive(blankInteractive)},
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	x11Channels := client.HandleChannelOpen("x11")
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = session.Close() }()
+	if ok, err := session.SendRequest("x11-req", true, x11Payload(real)); err != nil || !ok {
+		t.Fatalf("expected X11 forwarding to be accepted: %v", err)
+	}
+
+	// the target is only given a fake cookie
+	select {
+	case cookie := <-cookies:
+		if len(cookie) != len(real) || bytes.Equal(cookie, real) {
+			t.Errorf("expected the target to be given a fake cookie, got %x", cookie)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the X11 request")
+	}
+
+	readX11Channel := func() []byte {
+		t.Helper()
+		select {
+		case nc := <-x11Channels:
+			channel, requests, err := nc.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			go ssh.DiscardRequests(requests)
+			defer func() { _ = channel.Close() }()
+			data, _ := io.ReadAll(channel)
+			return data
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for an X11 channel")
+			return nil
+		}
+	}
+	// X clients presenting the fake cookie reach the X server with the real one
+	if data, expected := readX11Channel(), append(x11Setup(binary.LittleEndian, x11Protocol, real),
+		following...); !bytes.Equal(data, expected) {
+		t.Errorf("expected the setup with the real cookie, got %q", data)
+	}
+	// and others don't reach it at all
+	if data := readX11Channel(); len(data) > 0 {
+		t.Errorf("expected nothing from an X client with the wrong cookie, got %q", data)
+	}
+}